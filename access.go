@@ -98,6 +98,15 @@ func setAccessKeyCookies(w http.ResponseWriter, siteURL, fileName, value string,
 	http.SetCookie(w, &cookie)
 }
 
+// accessKeyCookieExpiry is when a new access key cookie expires, the zero
+// time makes it a session cookie
+func accessKeyCookieExpiry() time.Time {
+	if Config.accessKeyCookieExpiry == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(Config.accessKeyCookieExpiry) * time.Second)
+}
+
 func fileAccessHandler(c echo.Context) error {
 	r := c.Request()
 	w := c.Response().Writer
@@ -134,11 +143,7 @@ func fileAccessHandler(c echo.Context) error {
 	}
 
 	if metadata.AccessKey != "" {
-		var expiry time.Time
-		if Config.accessKeyCookieExpiry != 0 {
-			expiry = time.Now().Add(time.Duration(Config.accessKeyCookieExpiry) * time.Second)
-		}
-		setAccessKeyCookies(w, getSiteURL(r), fileName, metadata.AccessKey, expiry)
+		setAccessKeyCookies(w, getSiteURL(r), fileName, metadata.AccessKey, accessKeyCookieExpiry())
 	}
 
 	if c.QueryParam("blockbench_redirect") == "1" {
@@ -0,0 +1,329 @@
+package compressed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/andreimarcu/linx-server/httputil"
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Encoding marks files that are stored gzip compressed
+const Encoding = "gzip"
+
+var compressibleMimetypes = map[string]bool{
+	"application/json":       true,
+	"application/x-ndjson":   true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-sh":       true,
+	"application/x-yaml":     true,
+	"application/sql":        true,
+	"image/svg+xml":          true,
+}
+
+func compressible(mime string) bool {
+	mime, _, _ = strings.Cut(mime, ";")
+	return strings.HasPrefix(mime, "text/") || compressibleMimetypes[mime]
+}
+
+// acceptsGzip checks whether the client listed gzip in Accept-Encoding
+// without refusing it with q=0
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if !found {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// CompressedBackend stores text-like files gzip compressed in the wrapped
+// backend and decompresses them on the way out.
+type CompressedBackend struct {
+	base backends.MetaStorageBackend
+}
+
+func (b CompressedBackend) Delete(ctx context.Context, key string) error {
+	return b.base.Delete(ctx, key)
+}
+
+func (b CompressedBackend) Exists(ctx context.Context, key string) (bool, error) {
+	return b.base.Exists(ctx, key)
+}
+
+func (b CompressedBackend) Reserve(ctx context.Context, key string) error {
+	return backends.Reserve(ctx, b.base, key)
+}
+
+func (b CompressedBackend) Head(ctx context.Context, key string) (backends.Metadata, error) {
+	metadata, err := b.base.Head(ctx, key)
+	if err != nil {
+		return metadata, err
+	}
+
+	metadata.Encoding, _ = backends.PopEncoding(metadata.Encoding, Encoding)
+	return metadata, nil
+}
+
+func (b CompressedBackend) Get(ctx context.Context, key string) (backends.Metadata, io.ReadCloser, error) {
+	metadata, r, err := b.base.Get(ctx, key)
+	if err != nil {
+		return metadata, r, err
+	}
+
+	var compressed bool
+	metadata.Encoding, compressed = backends.PopEncoding(metadata.Encoding, Encoding)
+	if !compressed {
+		return metadata, r, nil
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		r.Close()
+		return metadata, nil, err
+	}
+
+	return metadata, gzipReadCloser{gz, r}, nil
+}
+
+func (b CompressedBackend) ServeFile(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) error {
+	metadata, err := b.base.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	var compressed bool
+	metadata.Encoding, compressed = backends.PopEncoding(metadata.Encoding, Encoding)
+	if !compressed {
+		return b.base.ServeFile(ctx, key, w, r)
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// Ranges refer to the uncompressed file, everything else can be sent
+	// as it is stored
+	if r.Header.Get("Range") == "" && acceptsGzip(r) {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		if etag := w.Header().Get("Etag"); strings.HasPrefix(etag, `"`) {
+			w.Header().Set("Etag", "W/"+etag)
+		}
+
+		// ServeContent would offer ranges of the compressed bytes, so the
+		// conditional headers are checked here instead
+		if httputil.CheckPreconditions(w, r, backends.ServeModTime(w, time.Time{})) {
+			return nil
+		}
+
+		_, reader, err := b.base.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		_, err = io.Copy(w, reader)
+		return err
+	}
+
+	seeker := &gunzipSeeker{ctx: ctx, base: b.base, key: key, size: metadata.Size}
+	defer seeker.Close()
+
+	http.ServeContent(w, r, "", backends.ServeModTime(w, time.Time{}), seeker)
+	return nil
+}
+
+func (b CompressedBackend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
+	header := make([]byte, helpers.MimetypeDetectLimit)
+	n, err := io.ReadFull(r, header)
+	if n == 0 {
+		if err == io.EOF {
+			err = backends.FileEmptyError
+		}
+		return
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return
+	}
+	header = header[:n]
+	src := io.MultiReader(bytes.NewReader(header), r)
+
+	if !compressible(mimetype.Detect(header).String()) {
+		return b.base.Put(ctx, key, originalName, src, expiry, deleteKey, accessKey)
+	}
+
+	mr := helpers.NewMetadataReader(src)
+	pr, pw := io.Pipe()
+	compressErr := make(chan error, 1)
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, mr)
+		err = errors.Join(err, gz.Close())
+		pw.CloseWithError(err)
+		compressErr <- err
+	}()
+
+	m, err = b.base.Put(ctx, key, originalName, pr, expiry, deleteKey, accessKey)
+	pr.CloseWithError(err)
+	if compErr := <-compressErr; err != nil && compErr != nil {
+		err = compErr
+	}
+	if err != nil {
+		return
+	}
+
+	plain := mr.Metadata()
+	m.Size = plain.Size
+	m.Sha256sum = plain.Sha256sum
+	m.Mimetype = plain.Mimetype
+	m.ArchiveFiles = nil
+
+	stored := m
+	stored.Encoding = backends.PushEncoding(m.Encoding, Encoding)
+	err = b.base.PutMetadata(ctx, key, stored)
+	if err != nil {
+		b.base.Delete(ctx, key)
+		return
+	}
+
+	return
+}
+
+func (b CompressedBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	stored, err := b.base.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if _, compressed := backends.PopEncoding(stored.Encoding, Encoding); compressed {
+		m.Encoding = backends.PushEncoding(m.Encoding, Encoding)
+	}
+
+	return b.base.PutMetadata(ctx, key, m)
+}
+
+// MarkAccessed leaves the stored metadata as it is, the access time is the
+// same for the compressed file
+func (b CompressedBackend) MarkAccessed(ctx context.Context, key string, t time.Time) error {
+	return backends.MarkAccessed(ctx, b.base, key, t)
+}
+
+func (b CompressedBackend) Size(ctx context.Context, key string) (int64, error) {
+	metadata, err := b.Head(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return metadata.Size, nil
+}
+
+func (b CompressedBackend) List(ctx context.Context) ([]string, error) {
+	return b.base.List(ctx)
+}
+
+func (b CompressedBackend) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	return backends.ListExpired(ctx, b.base, before)
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	return errors.Join(g.Reader.Close(), g.body.Close())
+}
+
+// gunzipSeeker decompresses a stored file on the fly. Seeking backwards
+// restarts decompression from the beginning of the file.
+type gunzipSeeker struct {
+	ctx    context.Context
+	base   backends.StorageBackend
+	key    string
+	size   int64
+	offset int64
+
+	reader    io.ReadCloser
+	readerPos int64
+}
+
+func (g *gunzipSeeker) Read(p []byte) (int, error) {
+	if g.offset >= g.size {
+		return 0, io.EOF
+	}
+
+	if g.reader == nil || g.readerPos > g.offset {
+		g.Close()
+		_, r, err := g.base.Get(g.ctx, g.key)
+		if err != nil {
+			return 0, err
+		}
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return 0, err
+		}
+		g.reader = gzipReadCloser{gz, r}
+		g.readerPos = 0
+	}
+
+	if skip := g.offset - g.readerPos; skip > 0 {
+		skipped, err := io.CopyN(io.Discard, g.reader, skip)
+		g.readerPos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := g.reader.Read(p)
+	g.readerPos += int64(n)
+	g.offset += int64(n)
+	return n, err
+}
+
+func (g *gunzipSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += g.offset
+	case io.SeekEnd:
+		offset += g.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	g.offset = offset
+	return offset, nil
+}
+
+func (g *gunzipSeeker) Close() error {
+	if g.reader == nil {
+		return nil
+	}
+	err := g.reader.Close()
+	g.reader = nil
+	return err
+}
+
+func NewCompressedBackend(base backends.MetaStorageBackend) CompressedBackend {
+	return CompressedBackend{base: base}
+}
@@ -0,0 +1,139 @@
+package compressed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+var text = strings.Repeat("some compressible text\n", 1000)
+
+func newTestBackend(t *testing.T) (CompressedBackend, memory.MemoryBackend) {
+	base := memory.NewMemoryBackend(0)
+	b := NewCompressedBackend(base)
+
+	_, err := b.Put(context.Background(), "a.txt", "a.txt", strings.NewReader(text), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, base
+}
+
+func readAll(t *testing.T, r io.ReadCloser) []byte {
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func serve(t *testing.T, b backends.StorageBackend, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/a.txt", nil)
+	req.Header = header
+	w := httptest.NewRecorder()
+	w.Header().Set("Etag", `"abc"`)
+
+	err := b.ServeFile(context.Background(), "a.txt", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestTextIsCompressed(t *testing.T) {
+	ctx := context.Background()
+	b, base := newTestBackend(t)
+
+	stored, r, err := base.Get(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := readAll(t, r)
+	if stored.Encoding != Encoding || len(data) >= len(text) {
+		t.Fatalf("Text was not stored compressed (encoding %q, %d bytes)", stored.Encoding, len(data))
+	}
+
+	metadata, r, err := b.Get(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(readAll(t, r)) != text {
+		t.Fatal("Decompressed file differs from the upload")
+	}
+	if metadata.Encoding != "" || metadata.Size != int64(len(text)) || !strings.HasPrefix(metadata.Mimetype, "text/plain") {
+		t.Fatalf("Metadata describes the stored bytes: %+v", metadata)
+	}
+}
+
+func TestBinaryIsNotCompressed(t *testing.T) {
+	ctx := context.Background()
+	base := memory.NewMemoryBackend(0)
+	b := NewCompressedBackend(base)
+
+	data := make([]byte, 4096)
+	rand.Read(data)
+	_, err := b.Put(ctx, "a.bin", "a.bin", bytes.NewReader(data), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, r, err := base.Get(ctx, "a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Encoding != "" || !bytes.Equal(readAll(t, r), data) {
+		t.Fatal("Binary file was compressed")
+	}
+}
+
+func TestServeGzip(t *testing.T) {
+	b, _ := newTestBackend(t)
+
+	w := serve(t, b, http.Header{"Accept-Encoding": {"gzip"}})
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Gzip was not passed through (%d, %q)", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(readAll(t, gz)) != text {
+		t.Fatal("Served gzip differs from the upload")
+	}
+
+	w = serve(t, b, http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {`W/"abc"`}})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("Matching If-None-Match returned %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	w = serve(t, b, http.Header{"Accept-Encoding": {"gzip"}, "If-Match": {`"other"`}})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Failed If-Match returned %d", w.Code)
+	}
+}
+
+func TestServePlain(t *testing.T) {
+	b, _ := newTestBackend(t)
+
+	w := serve(t, b, http.Header{"Accept-Encoding": {"gzip;q=0"}})
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "" || w.Body.String() != text {
+		t.Fatalf("Client refusing gzip got %d %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+
+	// ranges refer to the decompressed file
+	w = serve(t, b, http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=23-45"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != text[23:46] {
+		t.Fatalf("Range request returned %d '%s'", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,43 @@
+package backends
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/minio/sha256-simd"
+)
+
+// Copy transfers a stored file and its metadata unchanged from one backend to
+// another and verifies that the destination received the same bytes and that
+// they still match the checksum in the metadata.
+func Copy(ctx context.Context, key string, from, to StorageBackend) error {
+	metadata, reader, err := from.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	stored, err := to.Put(ctx, key, metadata.OriginalName, io.TeeReader(reader, hasher), metadata.Expiry, metadata.DeleteKey, metadata.AccessKey)
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	if stored.Sha256sum != sum {
+		to.Delete(ctx, key)
+		return fmt.Errorf("checksum mismatch after copy: %s != %s", stored.Sha256sum, sum)
+	}
+	// the checksum in the metadata is only that of the stored bytes if no
+	// wrapping backend transformed them
+	if metadata.Encoding == "" && metadata.Sha256sum != "" && metadata.Sha256sum != sum {
+		to.Delete(ctx, key)
+		return fmt.Errorf("source file does not match its checksum: %s != %s", metadata.Sha256sum, sum)
+	}
+
+	// Put derives the metadata from the stored bytes, restore the original
+	// one in case a wrapping backend stored something else in it
+	return to.PutMetadata(ctx, key, metadata)
+}
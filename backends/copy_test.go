@@ -0,0 +1,99 @@
+package backends_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/compressed"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func read(t *testing.T, b backends.StorageBackend, key string) (backends.Metadata, string) {
+	metadata, r, err := b.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata, string(data)
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	from := memory.NewMemoryBackend(0)
+	to := memory.NewMemoryBackend(0)
+
+	original, err := from.Put(ctx, "a.txt", "original.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "acc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backends.Copy(ctx, "a.txt", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, content := read(t, to, "a.txt")
+	if content != "content" {
+		t.Fatalf("Copied file has content '%s'", content)
+	}
+	if metadata.OriginalName != "original.txt" || metadata.DeleteKey != "del" || metadata.AccessKey != "acc" || !metadata.CreatedAt.Equal(original.CreatedAt) {
+		t.Fatalf("Metadata was not kept: %+v", metadata)
+	}
+}
+
+func TestCopyKeepsEncodedFiles(t *testing.T) {
+	ctx := context.Background()
+	from := memory.NewMemoryBackend(0)
+	to := memory.NewMemoryBackend(0)
+	text := strings.Repeat("compressible text ", 100)
+
+	_, err := compressed.NewCompressedBackend(from).Put(ctx, "a.txt", "a.txt", strings.NewReader(text), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backends.Copy(ctx, "a.txt", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata, _ := to.Head(ctx, "a.txt"); metadata.Encoding != compressed.Encoding {
+		t.Fatal("Copied file lost its encoding")
+	}
+	if _, content := read(t, compressed.NewCompressedBackend(to), "a.txt"); content != text {
+		t.Fatal("Copied file can't be decompressed")
+	}
+}
+
+func TestCopyCorruptFile(t *testing.T) {
+	ctx := context.Background()
+	from := memory.NewMemoryBackend(0)
+	to := memory.NewMemoryBackend(0)
+
+	metadata, err := from.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.Sha256sum = strings.Repeat("0", 64)
+	err = from.PutMetadata(ctx, "a.txt", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backends.Copy(ctx, "a.txt", from, to)
+	if err == nil {
+		t.Fatal("File that doesn't match its checksum was copied")
+	}
+	if exists, _ := to.Exists(ctx, "a.txt"); exists {
+		t.Fatal("Corrupt file was left at the destination")
+	}
+}
@@ -0,0 +1,451 @@
+package encrypted
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+)
+
+// Encoding marks files whose stored bytes and sensitive metadata are encrypted
+const Encoding = "aes-256-gcm"
+
+const (
+	// Files are sealed in chunks so any part of them can be decrypted
+	// without reading everything in front of it
+	chunkSize = 64 * 1024
+	overhead  = 16
+	saltSize  = 32
+)
+
+var InvalidKeyError = errors.New("encryption key must be 32 bytes")
+
+// EncryptedBackend encrypts files and the secrets in their metadata before
+// handing them to the wrapped backend.
+type EncryptedBackend struct {
+	base    backends.MetaStorageBackend
+	key     []byte
+	metaKey cipher.AEAD
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// fileAEAD derives the key of a single file from the server key and the
+// random salt stored in front of the file
+func (b EncryptedBackend) fileAEAD(salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, b.key, salt, "linx-server file", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAEAD(key)
+}
+
+// chunkNonce numbers the chunks of a file and flags the last one, so chunks
+// can't be reordered and a truncated file doesn't decrypt.
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func storedSize(size int64) int64 {
+	chunks := (size + chunkSize - 1) / chunkSize
+	return saltSize + size + chunks*overhead
+}
+
+// plainSize works out the decrypted size from the stored file, as wrappers
+// on top of this backend may have replaced the size in the metadata
+func (b EncryptedBackend) plainSize(ctx context.Context, key string) (int64, error) {
+	size, err := b.base.Size(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	size -= saltSize
+	chunks := (size + chunkSize + overhead - 1) / (chunkSize + overhead)
+	return size - chunks*overhead, nil
+}
+
+func (b EncryptedBackend) encrypt(w io.Writer, r io.Reader, salt []byte, aead cipher.AEAD) error {
+	cur := make([]byte, chunkSize)
+	next := make([]byte, chunkSize)
+	sealed := make([]byte, 0, chunkSize+overhead)
+
+	n, err := io.ReadFull(r, cur)
+	if err == io.EOF {
+		return backends.FileEmptyError
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	if _, err := w.Write(salt); err != nil {
+		return err
+	}
+
+	for index := int64(0); ; index++ {
+		// a short read means the current chunk is the last one, otherwise
+		// read ahead to find out
+		last := err == io.ErrUnexpectedEOF
+		var m int
+		if !last {
+			m, err = io.ReadFull(r, next)
+			if err == io.EOF {
+				last = true
+			} else if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(index, last), cur[:n], nil)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+		cur, next = next, cur
+		n = m
+	}
+}
+
+func (b EncryptedBackend) seal(key, field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	nonce := make([]byte, b.metaKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.metaKey.Seal(nonce, nonce, []byte(value), []byte(key+"\x00"+field))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (b EncryptedBackend) open(key, field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < b.metaKey.NonceSize() {
+		return "", backends.BadMetadata
+	}
+
+	nonce, sealed := sealed[:b.metaKey.NonceSize()], sealed[b.metaKey.NonceSize():]
+	plain, err := b.metaKey.Open(nil, nonce, sealed, []byte(key+"\x00"+field))
+	if err != nil {
+		return "", backends.BadMetadata
+	}
+	return string(plain), nil
+}
+
+func (b EncryptedBackend) encryptMetadata(key string, m backends.Metadata) (backends.Metadata, error) {
+	var errs [5]error
+	m.Encoding = backends.PushEncoding(m.Encoding, Encoding)
+	m.OriginalName, errs[0] = b.seal(key, "original_name", m.OriginalName)
+	m.DeleteKey, errs[1] = b.seal(key, "delete_key", m.DeleteKey)
+	m.AccessKey, errs[2] = b.seal(key, "access_key", m.AccessKey)
+	m.Sha256sum, errs[3] = b.seal(key, "sha256sum", m.Sha256sum)
+
+	if len(m.ArchiveFiles) > 0 {
+		files, _ := json.Marshal(m.ArchiveFiles)
+		var sealed string
+		sealed, errs[4] = b.seal(key, "archive_files", string(files))
+		m.ArchiveFiles = []string{sealed}
+	}
+
+	return m, errors.Join(errs[:]...)
+}
+
+// decryptMetadata returns the metadata as it was before encryption and
+// whether the file is encrypted at all
+func (b EncryptedBackend) decryptMetadata(key string, m backends.Metadata) (backends.Metadata, bool, error) {
+	var encrypted bool
+	m.Encoding, encrypted = backends.PopEncoding(m.Encoding, Encoding)
+	if !encrypted {
+		return m, false, nil
+	}
+
+	var errs [4]error
+	m.OriginalName, errs[0] = b.open(key, "original_name", m.OriginalName)
+	m.DeleteKey, errs[1] = b.open(key, "delete_key", m.DeleteKey)
+	m.AccessKey, errs[2] = b.open(key, "access_key", m.AccessKey)
+	m.Sha256sum, errs[3] = b.open(key, "sha256sum", m.Sha256sum)
+	if err := errors.Join(errs[:]...); err != nil {
+		return m, true, backends.BadMetadata
+	}
+
+	if len(m.ArchiveFiles) == 1 {
+		files, err := b.open(key, "archive_files", m.ArchiveFiles[0])
+		if err != nil {
+			return m, true, err
+		}
+		m.ArchiveFiles = nil
+		json.Unmarshal([]byte(files), &m.ArchiveFiles)
+	}
+
+	return m, true, nil
+}
+
+func (b EncryptedBackend) Delete(ctx context.Context, key string) error {
+	return b.base.Delete(ctx, key)
+}
+
+func (b EncryptedBackend) Exists(ctx context.Context, key string) (bool, error) {
+	return b.base.Exists(ctx, key)
+}
+
+func (b EncryptedBackend) Reserve(ctx context.Context, key string) error {
+	return backends.Reserve(ctx, b.base, key)
+}
+
+func (b EncryptedBackend) Head(ctx context.Context, key string) (backends.Metadata, error) {
+	metadata, err := b.base.Head(ctx, key)
+	if err != nil {
+		return metadata, err
+	}
+
+	metadata, _, err = b.decryptMetadata(key, metadata)
+	return metadata, err
+}
+
+func (b EncryptedBackend) Get(ctx context.Context, key string) (backends.Metadata, io.ReadCloser, error) {
+	metadata, r, err := b.base.Get(ctx, key)
+	if err != nil {
+		return metadata, r, err
+	}
+
+	metadata, encrypted, err := b.decryptMetadata(key, metadata)
+	if err != nil || !encrypted {
+		if err != nil {
+			r.Close()
+		}
+		return metadata, r, err
+	}
+
+	salt := make([]byte, saltSize)
+	_, err = io.ReadFull(r, salt)
+	if err != nil {
+		r.Close()
+		return metadata, nil, err
+	}
+
+	aead, err := b.fileAEAD(salt)
+	if err != nil {
+		r.Close()
+		return metadata, nil, err
+	}
+
+	size, err := b.plainSize(ctx, key)
+	if err != nil {
+		r.Close()
+		return metadata, nil, err
+	}
+
+	pr := newPlainReader(ctx, b.base, key, aead, size)
+	pr.stream = r
+	return metadata, pr, nil
+}
+
+// openPlain returns a seekable reader of the decrypted file
+func (b EncryptedBackend) openPlain(ctx context.Context, key string) (*plainReader, error) {
+	size, err := b.plainSize(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := backends.GetRange(ctx, b.base, key, 0, saltSize)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	salt := make([]byte, saltSize)
+	_, err = io.ReadFull(r, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := b.fileAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPlainReader(ctx, b.base, key, aead, size), nil
+}
+
+func (b EncryptedBackend) ServeFile(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) error {
+	metadata, err := b.base.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	_, encrypted, err := b.decryptMetadata(key, metadata)
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		return b.base.ServeFile(ctx, key, w, r)
+	}
+
+	pr, err := b.openPlain(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+
+	http.ServeContent(w, r, "", backends.ServeModTime(w, time.Time{}), pr)
+	return nil
+}
+
+func (b EncryptedBackend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
+	salt := make([]byte, saltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	aead, err := b.fileAEAD(salt)
+	if err != nil {
+		return
+	}
+
+	// the keys are sealed right away, so the file is protected before its
+	// metadata is complete, also if that never happens
+	sealedDeleteKey, err := b.seal(key, "delete_key", deleteKey)
+	if err != nil {
+		return
+	}
+	sealedAccessKey, err := b.seal(key, "access_key", accessKey)
+	if err != nil {
+		return
+	}
+
+	mr := helpers.NewMetadataReader(r)
+	pr, pw := io.Pipe()
+	encryptErr := make(chan error, 1)
+	go func() {
+		err := b.encrypt(pw, mr, salt, aead)
+		pw.CloseWithError(err)
+		encryptErr <- err
+	}()
+
+	// the file is marked as encrypted right away, so its ciphertext is
+	// never taken for the upload
+	stored, err := b.base.Put(backends.WithEncoding(ctx, Encoding), key, "", pr, expiry, sealedDeleteKey, sealedAccessKey)
+	pr.CloseWithError(err)
+	// reading the upload may have failed before anything reached the
+	// backend, which would otherwise only see an empty file
+	if encErr := <-encryptErr; err != nil && encErr != nil {
+		err = encErr
+	}
+	if err != nil {
+		return
+	}
+
+	m = mr.Metadata()
+	m.OriginalName = originalName
+	m.Expiry = expiry
+	m.DeleteKey = deleteKey
+	m.AccessKey = accessKey
+	m.Encoding = backends.EncodingOf(ctx)
+	m.CreatedAt = stored.CreatedAt
+
+	plain := newPlainReader(ctx, b.base, key, aead, m.Size)
+	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, plain)
+	plain.Close()
+
+	sealed, err := b.encryptMetadata(key, m)
+	if err == nil {
+		err = b.base.PutMetadata(ctx, key, sealed)
+	}
+	if err != nil {
+		b.base.Delete(ctx, key)
+		return
+	}
+
+	return
+}
+
+func (b EncryptedBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	stored, err := b.base.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if _, encrypted := backends.PopEncoding(stored.Encoding, Encoding); encrypted {
+		m, err = b.encryptMetadata(key, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.base.PutMetadata(ctx, key, m)
+}
+
+// MarkAccessed leaves the sealed metadata as it is, the access time is not
+// encrypted
+func (b EncryptedBackend) MarkAccessed(ctx context.Context, key string, t time.Time) error {
+	return backends.MarkAccessed(ctx, b.base, key, t)
+}
+
+func (b EncryptedBackend) Size(ctx context.Context, key string) (int64, error) {
+	metadata, err := b.Head(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return metadata.Size, nil
+}
+
+func (b EncryptedBackend) List(ctx context.Context) ([]string, error) {
+	return b.base.List(ctx)
+}
+
+func (b EncryptedBackend) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	return backends.ListExpired(ctx, b.base, before)
+}
+
+func NewEncryptedBackend(base backends.MetaStorageBackend, key []byte) (EncryptedBackend, error) {
+	if len(key) != 32 {
+		return EncryptedBackend{}, InvalidKeyError
+	}
+
+	metaKey, err := hkdf.Key(sha256.New, key, nil, "linx-server metadata", 32)
+	if err != nil {
+		return EncryptedBackend{}, err
+	}
+
+	metaAEAD, err := newAEAD(metaKey)
+	if err != nil {
+		return EncryptedBackend{}, err
+	}
+
+	return EncryptedBackend{
+		base:    base,
+		key:     key,
+		metaKey: metaAEAD,
+	}, nil
+}
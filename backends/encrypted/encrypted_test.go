@@ -0,0 +1,167 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+// recordingBackend remembers the metadata the encrypted backend stored a
+// file with before its metadata was complete
+type recordingBackend struct {
+	memory.MemoryBackend
+	first *[]backends.Metadata
+}
+
+func (b recordingBackend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (backends.Metadata, error) {
+	m, err := b.MemoryBackend.Put(ctx, key, originalName, r, expiry, deleteKey, accessKey)
+	*b.first = append(*b.first, m)
+	return m, err
+}
+
+func newTestBackend(t *testing.T) (EncryptedBackend, memory.MemoryBackend) {
+	base := memory.NewMemoryBackend(0)
+	b, err := NewEncryptedBackend(base, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, base
+}
+
+func readAll(t *testing.T, r io.ReadCloser) []byte {
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	b, base := newTestBackend(t)
+
+	// spans several chunks and ends with a partial one
+	content := bytes.Repeat([]byte("0123456789abcdef"), chunkSize/16*3+5)
+	m, err := b.Put(ctx, "a.bin", "secret name.bin", bytes.NewReader(content), expiry.NeverExpire, "del", "acc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != int64(len(content)) || m.DeleteKey != "del" {
+		t.Fatal("Put did not return the plain metadata")
+	}
+
+	_, stored, err := base.Get(ctx, "a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(readAll(t, stored), content[:64]) {
+		t.Fatal("File was stored unencrypted")
+	}
+	storedMeta, _ := base.Head(ctx, "a.bin")
+	if storedMeta.DeleteKey == "del" || storedMeta.AccessKey == "acc" || storedMeta.OriginalName == "secret name.bin" {
+		t.Fatal("Metadata secrets were stored unencrypted")
+	}
+
+	metadata, r, err := b.Get(ctx, "a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readAll(t, r), content) {
+		t.Fatal("Decrypted file differs from the upload")
+	}
+	if metadata.DeleteKey != "del" || metadata.AccessKey != "acc" || metadata.OriginalName != "secret name.bin" {
+		t.Fatal("Metadata was not decrypted")
+	}
+	if size, _ := b.Size(ctx, "a.bin"); size != int64(len(content)) {
+		t.Fatalf("Size is %d instead of %d", size, len(content))
+	}
+
+	// a range across a chunk boundary
+	req := httptest.NewRequest("GET", "/a.bin", nil)
+	req.Header.Set("Range", "bytes=65530-65545")
+	w := httptest.NewRecorder()
+	err = b.ServeFile(ctx, "a.bin", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[65530:65546]) {
+		t.Fatalf("Range request returned %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestPutMetadataStaysSealed(t *testing.T) {
+	ctx := context.Background()
+	b, base := newTestBackend(t)
+
+	m, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.DeleteKey = "new"
+	err = b.PutMetadata(ctx, "a.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storedMeta, _ := base.Head(ctx, "a.txt")
+	if storedMeta.DeleteKey == "new" {
+		t.Fatal("Updated delete key was stored unencrypted")
+	}
+	if metadata, _ := b.Head(ctx, "a.txt"); metadata.DeleteKey != "new" {
+		t.Fatalf("Delete key is '%s' after update", metadata.DeleteKey)
+	}
+}
+
+func TestPutProtectsFileBeforeMetadata(t *testing.T) {
+	ctx := context.Background()
+	var first []backends.Metadata
+	base := recordingBackend{memory.NewMemoryBackend(0), &first}
+	b, err := NewEncryptedBackend(base, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first) != 1 || first[0].DeleteKey == "" || first[0].DeleteKey == "del" {
+		t.Fatalf("File was first stored with the metadata %+v", first)
+	}
+	if first[0].Encoding != Encoding {
+		t.Fatalf("File was first stored with the encoding '%s'", first[0].Encoding)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	ctx := context.Background()
+	b, base := newTestBackend(t)
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := NewEncryptedBackend(base, bytes.Repeat([]byte{8}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.Head(ctx, "a.txt")
+	if err != backends.BadMetadata {
+		t.Fatalf("Reading with another key returned %v", err)
+	}
+}
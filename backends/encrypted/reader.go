@@ -0,0 +1,131 @@
+package encrypted
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"io"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// plainReader decrypts a stored file on the fly. Seeking only reopens the
+// stored file when the reader jumps to a chunk other than the next one.
+type plainReader struct {
+	ctx    context.Context
+	base   backends.StorageBackend
+	key    string
+	aead   cipher.AEAD
+	size   int64
+	offset int64
+
+	stream      io.ReadCloser
+	streamChunk int64
+	chunk       []byte
+	chunkIndex  int64
+	sealed      []byte
+}
+
+func newPlainReader(ctx context.Context, base backends.StorageBackend, key string, aead cipher.AEAD, size int64) *plainReader {
+	return &plainReader{
+		ctx:        ctx,
+		base:       base,
+		key:        key,
+		aead:       aead,
+		size:       size,
+		chunk:      make([]byte, 0, chunkSize),
+		chunkIndex: -1,
+		sealed:     make([]byte, chunkSize+overhead),
+	}
+}
+
+func (pr *plainReader) loadChunk(index int64) error {
+	if pr.stream == nil || pr.streamChunk != index {
+		if pr.stream != nil {
+			pr.stream.Close()
+			pr.stream = nil
+		}
+
+		offset := saltSize + index*(chunkSize+overhead)
+		stream, err := backends.GetRange(pr.ctx, pr.base, pr.key, offset, storedSize(pr.size)-offset)
+		if err != nil {
+			return err
+		}
+		pr.stream = stream
+		pr.streamChunk = index
+	}
+
+	length := min(int64(chunkSize), pr.size-index*chunkSize)
+	sealed := pr.sealed[:length+overhead]
+	_, err := io.ReadFull(pr.stream, sealed)
+	if err != nil {
+		return err
+	}
+	pr.streamChunk++
+
+	last := index == (pr.size-1)/chunkSize
+	pr.chunk, err = pr.aead.Open(pr.chunk[:0], chunkNonce(index, last), sealed, nil)
+	if err != nil {
+		pr.chunkIndex = -1
+		return backends.BadMetadata
+	}
+	pr.chunkIndex = index
+
+	return nil
+}
+
+func (pr *plainReader) Read(p []byte) (int, error) {
+	if pr.offset >= pr.size {
+		return 0, io.EOF
+	}
+
+	index := pr.offset / chunkSize
+	if index != pr.chunkIndex {
+		if err := pr.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, pr.chunk[pr.offset-index*chunkSize:])
+	pr.offset += int64(n)
+	return n, nil
+}
+
+func (pr *plainReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += pr.offset
+	case io.SeekEnd:
+		offset += pr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	pr.offset = offset
+	return offset, nil
+}
+
+func (pr *plainReader) ReadAt(p []byte, off int64) (n int, err error) {
+	saved := pr.offset
+	defer func() { pr.offset = saved }()
+
+	pr.offset = off
+	n, err = io.ReadFull(pr, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return
+}
+
+func (pr *plainReader) Close() error {
+	if pr.stream == nil {
+		return nil
+	}
+	err := pr.stream.Close()
+	pr.stream = nil
+	return err
+}
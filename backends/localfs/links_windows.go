@@ -0,0 +1,9 @@
+package localfs
+
+import "os"
+
+// linkCount returns the number of hard links of a file, if the platform
+// reports it
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -2,46 +2,59 @@ package localfs
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
 	"github.com/andreimarcu/linx-server/helpers"
 	"github.com/shirou/gopsutil/v4/disk"
 )
 
+// LocalfsBackend stores files in filesPath and their metadata as JSON in
+// metaPath. Without a metaPath only the files are stored, for use with a
+// separate metadata store.
 type LocalfsBackend struct {
 	metaPath       string
 	filesPath      string
 	minFreeSpaceGB float64
+	dedup          bool
+	sharded        bool
 }
 
-type MetadataJSON struct {
-	OriginalName string   `json:"original_name"`
-	DeleteKey    string   `json:"delete_key"`
-	AccessKey    string   `json:"access_key,omitempty"`
-	Sha256sum    string   `json:"sha256sum"`
-	Mimetype     string   `json:"mimetype"`
-	Size         int64    `json:"size"`
-	Expiry       int64    `json:"expiry"`
-	ArchiveFiles []string `json:"archive_files,omitempty"`
-}
+var InsufficientSpaceError = errors.New("insufficient disk space")
 
 func (b LocalfsBackend) Delete(ctx context.Context, key string) error {
-	return errors.Join(
-		os.Remove(path.Join(b.filesPath, key)),
-		os.Remove(path.Join(b.metaPath, key)),
-	)
+	filePath := b.filePath(key)
+
+	// files stored while deduplication was enabled keep their blob
+	// referenced even if the backend is no longer deduplicating
+	blobSum := b.linkedBlob(ctx, key)
+
+	fileErr := os.Remove(filePath)
+	err := fileErr
+	if b.metaPath != "" {
+		err = errors.Join(fileErr, os.Remove(b.metaFilePath(key)))
+	}
+	if fileErr == nil && blobSum != "" {
+		err = errors.Join(err, b.unlinkBlob(blobSum))
+	}
+	return err
 }
 
 func (b LocalfsBackend) Exists(ctx context.Context, key string) (bool, error) {
-	_, err := os.Stat(path.Join(b.filesPath, key))
+	_, err := os.Stat(b.filePath(key))
 	if err == nil {
 		return true, nil
 	} else if errors.Is(err, os.ErrNotExist) {
@@ -52,31 +65,27 @@ func (b LocalfsBackend) Exists(ctx context.Context, key string) (bool, error) {
 }
 
 func (b LocalfsBackend) Head(ctx context.Context, key string) (metadata backends.Metadata, err error) {
-	f, err := os.Open(path.Join(b.metaPath, key))
+	if b.metaPath == "" {
+		fileInfo, err := os.Stat(b.filePath(key))
+		if os.IsNotExist(err) {
+			return metadata, backends.NotFoundErr
+		} else if err != nil {
+			return metadata, err
+		}
+
+		metadata.Size = fileInfo.Size()
+		metadata.Expiry = expiry.NeverExpire
+		return metadata, nil
+	}
+
+	data, err := os.ReadFile(b.metaFilePath(key))
 	if os.IsNotExist(err) {
 		return metadata, backends.NotFoundErr
 	} else if err != nil {
 		return metadata, backends.BadMetadata
 	}
-	defer f.Close()
-
-	decoder := json.NewDecoder(f)
-
-	mjson := MetadataJSON{}
-	if err := decoder.Decode(&mjson); err != nil {
-		return metadata, backends.BadMetadata
-	}
 
-	metadata.OriginalName = mjson.OriginalName
-	metadata.DeleteKey = mjson.DeleteKey
-	metadata.AccessKey = mjson.AccessKey
-	metadata.Mimetype = mjson.Mimetype
-	metadata.ArchiveFiles = mjson.ArchiveFiles
-	metadata.Sha256sum = mjson.Sha256sum
-	metadata.Expiry = time.Unix(mjson.Expiry, 0)
-	metadata.Size = mjson.Size
-
-	return
+	return backends.DecodeMetadata(data)
 }
 
 func (b LocalfsBackend) Get(ctx context.Context, key string) (metadata backends.Metadata, f io.ReadCloser, err error) {
@@ -85,7 +94,7 @@ func (b LocalfsBackend) Get(ctx context.Context, key string) (metadata backends.
 		return
 	}
 
-	f, err = os.Open(path.Join(b.filesPath, key))
+	f, err = os.Open(b.filePath(key))
 	if err != nil {
 		return
 	}
@@ -93,49 +102,121 @@ func (b LocalfsBackend) Get(ctx context.Context, key string) (metadata backends.
 	return
 }
 
+func (b LocalfsBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(b.filePath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, backends.NotFoundErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
 func (b LocalfsBackend) ServeFile(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) (err error) {
 	_, err = b.Head(ctx, key)
 	if err != nil {
 		return
 	}
 
-	filePath := path.Join(b.filesPath, key)
-	http.ServeFile(w, r, filePath)
+	f, err := os.Open(b.filePath(key))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return
+	}
 
+	http.ServeContent(w, r, "", backends.ServeModTime(w, fileInfo.ModTime()), f)
 	return
 }
 
 func (b LocalfsBackend) writeMetadata(key string, metadata backends.Metadata) error {
-	metaPath := path.Join(b.metaPath, key)
+	if b.metaPath == "" {
+		return nil
+	}
+
+	metaPath := b.metaFilePath(key)
 
-	mjson := MetadataJSON{
-		OriginalName: metadata.OriginalName,
-		DeleteKey:    metadata.DeleteKey,
-		AccessKey:    metadata.AccessKey,
-		Mimetype:     metadata.Mimetype,
-		ArchiveFiles: metadata.ArchiveFiles,
-		Sha256sum:    metadata.Sha256sum,
-		Expiry:       metadata.Expiry.Unix(),
-		Size:         metadata.Size,
+	data, err := backends.EncodeMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	err = b.makeParent(metaPath, 0700)
+	if err != nil {
+		return err
 	}
 
-	dst, err := os.Create(metaPath)
+	// the metadata is replaced in one go so a crash can't leave it half written
+	dst, err := os.CreateTemp(path.Dir(metaPath), ".tmp-")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(dst.Name())
 	defer dst.Close()
 
-	encoder := json.NewEncoder(dst)
-	err = encoder.Encode(mjson)
+	_, err = dst.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	err = errors.Join(dst.Sync(), dst.Close())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(dst.Name(), metaPath)
 	if err != nil {
-		os.Remove(metaPath)
 		return err
 	}
+	syncDir(path.Dir(metaPath))
 
 	return nil
 }
 
+// Reserve claims the name of a new upload by creating an empty file in its
+// place, which fails if the name is already taken.
+func (b LocalfsBackend) Reserve(ctx context.Context, key string) error {
+	filePath := b.filePath(key)
+	err := b.makeParent(filePath, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return backends.FileExistsErr
+	} else if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// release removes the reservation of a name if no file was stored under it.
+// Uploads are never empty, so an empty file can only be a reservation.
+func release(filePath string) {
+	fileInfo, err := os.Lstat(filePath)
+	if err == nil && fileInfo.Mode().IsRegular() && fileInfo.Size() == 0 {
+		os.Remove(filePath)
+	}
+}
+
 func (b LocalfsBackend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
+	filePath := b.filePath(key)
+	defer func() {
+		if err != nil {
+			release(filePath)
+		}
+	}()
+
 	var cachedUsage *disk.UsageStat
 	minFreeBytes := uint64(b.minFreeSpaceGB * 1024 * 1024 * 1024)
 	if b.minFreeSpaceGB > 0 {
@@ -145,61 +226,100 @@ func (b LocalfsBackend) Put(ctx context.Context, key, originalName string, r io.
 		}
 
 		if cachedUsage.Free < minFreeBytes {
-			return m, fmt.Errorf("insufficient disk space: %.2f GB free, minimum required is %.2f GB",
-				float64(cachedUsage.Free)/(1024*1024*1024), b.minFreeSpaceGB)
+			return m, fmt.Errorf("%w: %.2f GB free, minimum required is %.2f GB",
+				InsufficientSpaceError, float64(cachedUsage.Free)/(1024*1024*1024), b.minFreeSpaceGB)
 		}
 	}
 
-	filePath := path.Join(b.filesPath, key)
-
-	dst, err := os.Create(filePath)
+	// The upload is written to a temporary file and only moved to its final
+	// name once it is complete. With deduplication it is written next to the
+	// blobs, as it becomes a blob itself if its checksum is new.
+	dstDir := path.Dir(filePath)
+	if b.dedup {
+		dstDir = b.blobsPath()
+	}
+	err = os.MkdirAll(dstDir, 0755)
+	if err != nil {
+		return
+	}
+	dst, err := os.CreateTemp(dstDir, ".upload-")
 	if err != nil {
 		return
 	}
 	defer dst.Close()
+	tmpPath := dst.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
 
-	bytes, err := io.Copy(dst, r)
+	// the upload is hashed while it is written, so it is only read once
+	mr := helpers.NewMetadataReader(r)
+	bytes, err := io.Copy(dst, mr)
 	if bytes == 0 {
-		os.Remove(filePath)
 		return m, backends.FileEmptyError
 	} else if err != nil {
-		os.Remove(filePath)
 		return m, err
 	}
 
 	if b.minFreeSpaceGB > 0 {
 		freeAfterUpload := cachedUsage.Free - uint64(bytes)
 		if freeAfterUpload < minFreeBytes {
-			os.Remove(filePath)
-			return m, fmt.Errorf("insufficient disk space: would have %.2f GB free after upload, minimum required is %.2f GB",
-				float64(freeAfterUpload)/(1024*1024*1024), b.minFreeSpaceGB)
+			return m, fmt.Errorf("%w: would have %.2f GB free after upload, minimum required is %.2f GB",
+				InsufficientSpaceError, float64(freeAfterUpload)/(1024*1024*1024), b.minFreeSpaceGB)
 		}
 	}
 
-	dst.Seek(0, 0)
-	m, err = helpers.GenerateMetadata(dst)
+	err = dst.Sync()
 	if err != nil {
-		os.Remove(filePath)
 		return
 	}
-	dst.Seek(0, 0)
 
+	m = mr.Metadata()
 	m.OriginalName = originalName
 	m.Expiry = expiry
+	m.CreatedAt = time.Now()
 	m.DeleteKey = deleteKey
 	m.AccessKey = accessKey
+	m.Encoding = backends.EncodingOf(ctx)
+	// only archives are read back to list their contents
+	dst.Seek(0, 0)
 	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, dst)
+	dst.Close()
 
+	// metadata without a file is cleaned up by Recover, while a file
+	// without its metadata couldn't be served
 	err = b.writeMetadata(key, m)
 	if err != nil {
-		os.Remove(filePath)
 		return
 	}
 
+	if b.dedup {
+		err = b.linkBlob(tmpPath, m.Sha256sum, filePath)
+	} else {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		if b.metaPath != "" {
+			os.Remove(b.metaFilePath(key))
+		}
+		return
+	}
+	syncDir(path.Dir(filePath))
+
 	return
 }
 
 func (b LocalfsBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) (err error) {
+	// don't bring back the metadata of a file that was deleted meanwhile
+	_, err = os.Stat(b.filePath(key))
+	if os.IsNotExist(err) {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+
 	err = b.writeMetadata(key, m)
 	if err != nil {
 		return
@@ -209,7 +329,7 @@ func (b LocalfsBackend) PutMetadata(ctx context.Context, key string, m backends.
 }
 
 func (b LocalfsBackend) Size(ctx context.Context, key string) (int64, error) {
-	fileInfo, err := os.Stat(path.Join(b.filesPath, key))
+	fileInfo, err := os.Stat(b.filePath(key))
 	if err != nil {
 		return 0, err
 	}
@@ -217,23 +337,50 @@ func (b LocalfsBackend) Size(ctx context.Context, key string) (int64, error) {
 	return fileInfo.Size(), nil
 }
 
+// ModTime returns the time the file was written to disk
+func (b LocalfsBackend) ModTime(ctx context.Context, key string) (time.Time, error) {
+	fileInfo, err := os.Stat(b.filePath(key))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return fileInfo.ModTime(), nil
+}
+
+// LowOnSpace reports whether the free disk space dropped below
+// minFreeSpaceGB. It is always false if no minimum is configured.
+func (b LocalfsBackend) LowOnSpace() (bool, error) {
+	if b.minFreeSpaceGB <= 0 {
+		return false, nil
+	}
+
+	usage, err := disk.Usage(b.filesPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to check disk usage: %w", err)
+	}
+
+	return usage.Free < uint64(b.minFreeSpaceGB*1024*1024*1024), nil
+}
+
 func (b LocalfsBackend) List(ctx context.Context) ([]string, error) {
 	seen := make(map[string]bool)
 
-	files, err := os.ReadDir(b.filesPath)
+	files, err := b.listDir(b.filesPath)
 	if err != nil {
 		return nil, err
 	}
-	for _, file := range files {
-		seen[file.Name()] = true
+	for _, name := range files {
+		seen[name] = true
 	}
 
-	metaFiles, err := os.ReadDir(b.metaPath)
-	if err != nil {
-		return nil, err
-	}
-	for _, file := range metaFiles {
-		seen[file.Name()] = true
+	if b.metaPath != "" {
+		metaFiles, err := b.listDir(b.metaPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range metaFiles {
+			seen[name] = true
+		}
 	}
 
 	var output []string
@@ -244,10 +391,387 @@ func (b LocalfsBackend) List(ctx context.Context) ([]string, error) {
 	return output, nil
 }
 
-func NewLocalfsBackend(metaPath string, filesPath string, minFreeSpaceGB float64) LocalfsBackend {
+// listDir returns the names stored in dir, descending into the shard
+// directories if needed
+func (b LocalfsBackend) listDir(dir string) ([]string, error) {
+	depth := 0
+	if b.sharded {
+		depth = 2
+	}
+
+	var output []string
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			// skip the blob store and unfinished uploads
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			if depth == 0 {
+				if !entry.IsDir() {
+					output = append(output, entry.Name())
+				}
+			} else if entry.IsDir() {
+				err := walk(path.Join(dir, entry.Name()), depth-1)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return output, walk(dir, depth)
+}
+
+// shardedPath spreads names over two levels of directories, so that no
+// directory ends up with millions of entries (e.g. 3f/a2/name)
+func shardedPath(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	prefix := hex.EncodeToString(sum[:2])
+	return path.Join(prefix[:2], prefix[2:], name)
+}
+
+func (b LocalfsBackend) filePath(key string) string {
+	if b.sharded {
+		return path.Join(b.filesPath, shardedPath(key))
+	}
+	return path.Join(b.filesPath, key)
+}
+
+func (b LocalfsBackend) metaFilePath(key string) string {
+	if b.sharded {
+		return path.Join(b.metaPath, shardedPath(key))
+	}
+	return path.Join(b.metaPath, key)
+}
+
+func (b LocalfsBackend) blobsPath() string {
+	return path.Join(b.filesPath, ".blobs")
+}
+
+func (b LocalfsBackend) blobPath(sha256sum string) string {
+	if b.sharded {
+		return path.Join(b.blobsPath(), sha256sum[:2], sha256sum[2:4], sha256sum)
+	}
+	return path.Join(b.blobsPath(), sha256sum)
+}
+
+// makeParent creates the shard directories of a path
+func (b LocalfsBackend) makeParent(p string, perm os.FileMode) error {
+	if !b.sharded {
+		return nil
+	}
+	return os.MkdirAll(path.Dir(p), perm)
+}
+
+// linkedBlob returns the checksum of the blob the stored file is hard linked
+// to, or an empty string if the file is not deduplicated. Wrappers replace
+// the checksum in the metadata with the one of the bytes they were given, so
+// if it doesn't lead to the blob the stored file is hashed again. That is
+// only done for files with more than one link.
+func (b LocalfsBackend) linkedBlob(ctx context.Context, key string) string {
+	if _, err := os.Stat(b.blobsPath()); err != nil {
+		return ""
+	}
+	fileInfo, err := os.Stat(b.filePath(key))
+	if err != nil {
+		return ""
+	}
+	if links, ok := linkCount(fileInfo); ok && links < 2 {
+		return ""
+	}
+
+	isBlob := func(sha256sum string) bool {
+		if len(sha256sum) != sha256.Size*2 {
+			return false
+		}
+		blobInfo, err := os.Stat(b.blobPath(sha256sum))
+		return err == nil && os.SameFile(fileInfo, blobInfo)
+	}
+
+	if metadata, err := b.Head(ctx, key); err == nil && isBlob(metadata.Sha256sum) {
+		return metadata.Sha256sum
+	}
+
+	f, err := os.Open(b.filePath(key))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return ""
+	}
+	sha256sum := hex.EncodeToString(hash.Sum(nil))
+	if !isBlob(sha256sum) {
+		return ""
+	}
+
+	return sha256sum
+}
+
+// lockBlobs serializes reference count updates of deduplicated blobs. It is
+// a file lock, so it also holds against linx-cleanup and other processes
+// sharing the store.
+func (b LocalfsBackend) lockBlobs() (unlock func(), err error) {
+	err = os.MkdirAll(b.blobsPath(), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path.Join(b.blobsPath(), ".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+func (b LocalfsBackend) blobRefs(sha256sum string) (int, error) {
+	data, err := os.ReadFile(b.blobPath(sha256sum) + ".refs")
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (b LocalfsBackend) setBlobRefs(sha256sum string, refs int) error {
+	refsPath := b.blobPath(sha256sum) + ".refs"
+	if refs <= 0 {
+		return errors.Join(
+			os.Remove(b.blobPath(sha256sum)),
+			os.Remove(refsPath),
+		)
+	}
+
+	return os.WriteFile(refsPath, []byte(strconv.Itoa(refs)), 0644)
+}
+
+// linkBlob moves a freshly written upload into the blob store, unless a blob
+// with the same checksum is already there, and hard links the blob to filePath.
+func (b LocalfsBackend) linkBlob(tmpPath, sha256sum, filePath string) error {
+	unlock, err := b.lockBlobs()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	blobPath := b.blobPath(sha256sum)
+
+	refs, err := b.blobRefs(sha256sum)
+	if err != nil {
+		return err
+	}
+
+	err = errors.Join(b.makeParent(blobPath, 0755), b.makeParent(filePath, 0755))
+	if err != nil {
+		return err
+	}
+
+	if refs == 0 {
+		err = os.Rename(tmpPath, blobPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		os.Remove(tmpPath)
+	}
+
+	// the link replaces the reservation of the name in one step
+	linkPath := path.Join(path.Dir(filePath), ".link-"+path.Base(filePath))
+	err = os.Link(blobPath, linkPath)
+	if err == nil {
+		err = os.Rename(linkPath, filePath)
+		if err != nil {
+			os.Remove(linkPath)
+		}
+	}
+	if err != nil {
+		if refs == 0 {
+			os.Remove(blobPath)
+		}
+		return err
+	}
+
+	return b.setBlobRefs(sha256sum, refs+1)
+}
+
+// unlinkBlob drops one reference to a blob and removes it once nothing
+// points at it anymore.
+func (b LocalfsBackend) unlinkBlob(sha256sum string) error {
+	unlock, err := b.lockBlobs()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	refs, err := b.blobRefs(sha256sum)
+	if err != nil {
+		return err
+	}
+
+	return b.setBlobRefs(sha256sum, refs-1)
+}
+
+// Recover removes what interrupted uploads left behind: temporary files,
+// unused reservations, metadata of files that were never stored and blobs
+// that nothing links to. It must only run while no uploads are in progress.
+func (b LocalfsBackend) Recover() (int, error) {
+	removed := 0
+	remove := func(p string) {
+		if os.Remove(p) == nil {
+			removed++
+		}
+	}
+
+	err := filepath.WalkDir(b.filesPath, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		name := entry.Name()
+		inBlobs := strings.HasPrefix(p, b.blobsPath()+string(filepath.Separator))
+		if name == ".lock" {
+			return nil
+		} else if strings.HasPrefix(name, ".upload-") || strings.HasPrefix(name, ".link-") {
+			remove(p)
+		} else if inBlobs && !strings.HasSuffix(name, ".refs") {
+			if _, err := os.Stat(p + ".refs"); errors.Is(err, os.ErrNotExist) {
+				remove(p)
+			}
+		} else if !inBlobs && !strings.HasPrefix(name, ".") {
+			if fileInfo, err := entry.Info(); err == nil && fileInfo.Size() == 0 {
+				remove(p)
+			}
+		}
+		return nil
+	})
+	if err != nil || b.metaPath == "" {
+		return removed, err
+	}
+
+	err = filepath.WalkDir(b.metaPath, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			remove(p)
+		} else if _, err := os.Stat(b.filePath(entry.Name())); errors.Is(err, os.ErrNotExist) {
+			remove(p)
+		}
+		return nil
+	})
+
+	return removed, err
+}
+
+// syncDir makes renames in dir durable. Not every platform can sync a
+// directory, so this is best effort.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+func NewLocalfsBackend(metaPath string, filesPath string, minFreeSpaceGB float64, dedup bool, sharded bool) LocalfsBackend {
 	return LocalfsBackend{
 		metaPath:       metaPath,
 		filesPath:      filesPath,
 		minFreeSpaceGB: minFreeSpaceGB,
+		dedup:          dedup,
+		sharded:        sharded,
+	}
+}
+
+// Shard moves the files, metadata and deduplicated blobs of a flat store into
+// the sharded layout and returns the number of moved entries. Entries that
+// are already sharded are left alone, so it can be rerun after a failure.
+func Shard(metaPath string, filesPath string) (int, error) {
+	flat := NewLocalfsBackend(metaPath, filesPath, 0, false, false)
+	sharded := NewLocalfsBackend(metaPath, filesPath, 0, false, true)
+	moved := 0
+
+	move := func(src, dst string) error {
+		err := os.MkdirAll(path.Dir(dst), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(src, dst)
+		if err != nil {
+			return err
+		}
+		moved++
+		return nil
+	}
+
+	for _, dir := range []string{filesPath, metaPath} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return moved, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			// unfinished resumable uploads are dropped rather than moved,
+			// they have to be started again
+			if backends.IsStaging(entry.Name()) {
+				var err error
+				if dir == filesPath {
+					err = flat.Delete(context.Background(), entry.Name())
+				} else {
+					err = os.Remove(path.Join(dir, entry.Name()))
+				}
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					return moved, err
+				}
+				continue
+			}
+			err := move(path.Join(dir, entry.Name()), path.Join(dir, shardedPath(entry.Name())))
+			if err != nil {
+				return moved, err
+			}
+		}
 	}
+
+	blobs, err := os.ReadDir(sharded.blobsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return moved, nil
+	} else if err != nil {
+		return moved, err
+	}
+	for _, entry := range blobs {
+		sha256sum, _, _ := strings.Cut(entry.Name(), ".")
+		if entry.IsDir() || len(sha256sum) != 64 {
+			continue
+		}
+		err := move(path.Join(sharded.blobsPath(), entry.Name()), path.Join(path.Dir(sharded.blobPath(sha256sum)), entry.Name()))
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	return moved, nil
 }
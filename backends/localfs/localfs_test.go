@@ -0,0 +1,367 @@
+package localfs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/compressed"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func newTestBackend(t *testing.T, dedup, sharded bool) LocalfsBackend {
+	dir := t.TempDir()
+	for _, sub := range []string{"meta", "files"} {
+		err := os.Mkdir(path.Join(dir, sub), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewLocalfsBackend(path.Join(dir, "meta"), path.Join(dir, "files"), 0, dedup, sharded)
+}
+
+func put(t *testing.T, b backends.StorageBackend, key, content string) backends.Metadata {
+	m, err := b.Put(context.Background(), key, key, strings.NewReader(content), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func blobCount(t *testing.T, b LocalfsBackend) int {
+	entries, err := os.ReadDir(b.blobsPath())
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestDedupSharesBlob(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, true, false)
+
+	m := put(t, b, "a.txt", "same content")
+	put(t, b, "b.txt", "same content")
+
+	aInfo, err := os.Stat(b.filePath("a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bInfo, err := os.Stat(b.filePath("b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(aInfo, bInfo) {
+		t.Fatal("Identical uploads are not linked to the same blob")
+	}
+	if refs, _ := b.blobRefs(m.Sha256sum); refs != 2 {
+		t.Fatalf("Blob has %d references instead of 2", refs)
+	}
+
+	err = b.Delete(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobCount(t, b) != 2 {
+		t.Fatal("Blob was removed while still referenced")
+	}
+
+	err = b.Delete(ctx, "b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := blobCount(t, b); n != 0 {
+		t.Fatalf("%d blob files are left after deleting every file", n)
+	}
+}
+
+func TestDedupDeleteBehindWrapper(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, true, true)
+	// the wrapper records the checksum of the uncompressed text
+	wrapped := compressed.NewCompressedBackend(b)
+
+	put(t, wrapped, "a.txt", strings.Repeat("compressible text ", 100))
+	put(t, wrapped, "b.txt", strings.Repeat("compressible text ", 100))
+
+	for _, key := range []string{"a.txt", "b.txt"} {
+		err := wrapped.Delete(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var left []string
+	err := walkFiles(b.blobsPath(), func(name string) {
+		if name != ".lock" {
+			left = append(left, name)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("Blob files were leaked: %v", left)
+	}
+}
+
+func TestDedupLockFileSurvivesRecover(t *testing.T) {
+	b := newTestBackend(t, true, false)
+	put(t, b, "a.txt", "content")
+
+	_, err := b.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(path.Join(b.blobsPath(), ".lock"))
+	if err != nil {
+		t.Fatal("Recover removed the blob lock file")
+	}
+	if blobCount(t, b) != 2 {
+		t.Fatal("Recover removed a referenced blob")
+	}
+}
+
+func walkFiles(dir string, fn func(name string)) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			err := walkFiles(path.Join(dir, entry.Name()), fn)
+			if err != nil {
+				return err
+			}
+		} else {
+			fn(entry.Name())
+		}
+	}
+	return nil
+}
+
+func TestShardedLayout(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, false, true)
+	put(t, b, "a.txt", "content")
+
+	for _, p := range []string{path.Join(b.filesPath, shardedPath("a.txt")), path.Join(b.metaPath, shardedPath("a.txt"))} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("%s was not stored in its shard directory", p)
+		}
+	}
+	if entries, _ := os.ReadDir(b.filesPath); len(entries) != 1 || !entries[0].IsDir() {
+		t.Fatal("Files directory has entries besides the shard directories")
+	}
+
+	files, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "a.txt" {
+		t.Fatalf("List returned %v", files)
+	}
+	if metadata, err := b.Head(ctx, "a.txt"); err != nil || metadata.Size != 7 {
+		t.Fatal("Sharded metadata could not be read")
+	}
+}
+
+func TestShard(t *testing.T) {
+	ctx := context.Background()
+	flat := newTestBackend(t, true, false)
+	put(t, flat, "a.txt", "same content")
+	put(t, flat, "b.txt", "same content")
+	put(t, flat, "c.txt", "other content")
+	put(t, flat, "staging-d.txt", "unfinished")
+
+	// the files, their metadata and the two blobs with their reference lists
+	moved, err := Shard(flat.metaPath, flat.filesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 10 {
+		t.Fatalf("Moved %d entries instead of 10", moved)
+	}
+
+	b := NewLocalfsBackend(flat.metaPath, flat.filesPath, 0, true, true)
+	files, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || slices.Contains(files, "staging-d.txt") {
+		t.Fatalf("List returned %v after sharding", files)
+	}
+	for _, key := range []string{"a.txt", "b.txt", "c.txt"} {
+		if _, err := b.Head(ctx, key); err != nil {
+			t.Fatalf("%s can't be read after sharding: %v", key, err)
+		}
+	}
+
+	// deduplication still works on the moved blobs
+	for _, key := range []string{"a.txt", "b.txt", "c.txt"} {
+		err := b.Delete(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var left []string
+	walkFiles(b.blobsPath(), func(name string) {
+		if name != ".lock" {
+			left = append(left, name)
+		}
+	})
+	if len(left) != 0 {
+		t.Fatalf("Blob files were leaked after sharding: %v", left)
+	}
+
+	moved, err = Shard(flat.metaPath, flat.filesPath)
+	if err != nil || moved != 0 {
+		t.Fatalf("Sharding again moved %d entries (%v)", moved, err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, false, false)
+
+	err := b.Reserve(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wrappers pass reservations through
+	err = backends.Reserve(ctx, compressed.NewCompressedBackend(b), "a.txt")
+	if err != backends.FileExistsErr {
+		t.Fatalf("Reserving a taken name returned %v", err)
+	}
+
+	put(t, b, "a.txt", "content")
+	if metadata, err := b.Head(ctx, "a.txt"); err != nil || metadata.Size != 7 {
+		t.Fatal("Upload was not stored under its reserved name")
+	}
+
+	// a failed upload gives its reservation back
+	err = b.Reserve(ctx, "b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put(ctx, "b.txt", "b.txt", strings.NewReader(""), expiry.NeverExpire, "", "")
+	if err != backends.FileEmptyError {
+		t.Fatalf("Storing an empty file returned %v", err)
+	}
+	err = b.Reserve(ctx, "b.txt")
+	if err != nil {
+		t.Fatalf("Name of a failed upload stays reserved: %v", err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	b := newTestBackend(t, false, false)
+	put(t, b, "a.txt", "content")
+
+	// leftovers of an interrupted upload, a reservation and a crash between
+	// writing the metadata and the file
+	leftovers := []string{
+		path.Join(b.filesPath, ".upload-123"),
+		path.Join(b.filesPath, "reserved.txt"),
+		path.Join(b.metaPath, ".tmp-123"),
+		path.Join(b.metaPath, "orphan.txt"),
+	}
+	for _, p := range leftovers {
+		err := os.WriteFile(p, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := b.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != len(leftovers) {
+		t.Fatalf("Recover removed %d entries instead of %d", removed, len(leftovers))
+	}
+	for _, p := range leftovers {
+		if _, err := os.Stat(p); err == nil {
+			t.Fatalf("%s was not removed", p)
+		}
+	}
+	if _, err := b.Head(context.Background(), "a.txt"); err != nil {
+		t.Fatal("Recover removed a stored file")
+	}
+}
+
+func TestServeFileKeepsLastModified(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, true, false)
+	put(t, b, "a.txt", "content")
+
+	created := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/a.txt", nil)
+		req.Header = header
+		w := httptest.NewRecorder()
+		w.Header().Set("Last-Modified", created.Format(http.TimeFormat))
+
+		err := b.ServeFile(ctx, "a.txt", w, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	w := serve(http.Header{})
+	if w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	if w.Header().Get("Last-Modified") != created.Format(http.TimeFormat) {
+		t.Fatalf("Last-Modified was replaced with %s", w.Header().Get("Last-Modified"))
+	}
+
+	w = serve(http.Header{"If-Modified-Since": {created.Add(time.Hour).Format(http.TimeFormat)}})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("Status code is not 304, but %d", w.Code)
+	}
+}
+
+func TestLinkedBlobOfSingleLink(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, true, false)
+	put(t, b, "a.txt", "content")
+
+	fileInfo, err := os.Stat(b.filePath("a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links, ok := linkCount(fileInfo); ok && links != 2 {
+		t.Fatalf("Deduplicated file has %d links", links)
+	}
+
+	// a file stored before deduplication was enabled
+	err = os.WriteFile(b.filePath("old.txt"), []byte("content"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := b.linkedBlob(ctx, "old.txt"); sum != "" {
+		t.Fatalf("File that is not linked is linked to blob %s", sum)
+	}
+	if sum := b.linkedBlob(ctx, "a.txt"); sum == "" {
+		t.Fatal("Deduplicated file is not linked to its blob")
+	}
+}
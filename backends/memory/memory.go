@@ -0,0 +1,220 @@
+package memory
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+)
+
+var FileTooLargeError = errors.New("file is larger than the memory storage")
+
+type memoryFile struct {
+	key      string
+	data     []byte
+	metadata backends.Metadata
+}
+
+// MemoryBackend keeps files in memory and evicts the least recently used
+// ones once the stored files exceed maxSize bytes.
+type MemoryBackend struct {
+	mu      *sync.Mutex
+	files   map[string]*list.Element
+	lru     *list.List // most recently used first
+	used    *int64
+	maxSize int64
+}
+
+func (b MemoryBackend) lookup(key string, touch bool) (*memoryFile, error) {
+	elem, ok := b.files[key]
+	if !ok {
+		return nil, backends.NotFoundErr
+	}
+	if touch {
+		b.lru.MoveToFront(elem)
+	}
+
+	return elem.Value.(*memoryFile), nil
+}
+
+func (b MemoryBackend) remove(elem *list.Element) {
+	file := elem.Value.(*memoryFile)
+	b.lru.Remove(elem)
+	delete(b.files, file.key)
+	*b.used -= int64(len(file.data))
+}
+
+func (b MemoryBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	elem, ok := b.files[key]
+	if !ok {
+		return backends.NotFoundErr
+	}
+	b.remove(elem)
+
+	return nil
+}
+
+func (b MemoryBackend) Exists(ctx context.Context, key string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.files[key]
+	return ok, nil
+}
+
+func (b MemoryBackend) Head(ctx context.Context, key string) (backends.Metadata, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	file, err := b.lookup(key, false)
+	if err != nil {
+		return backends.Metadata{}, err
+	}
+
+	return file.metadata, nil
+}
+
+func (b MemoryBackend) Get(ctx context.Context, key string) (backends.Metadata, io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	file, err := b.lookup(key, true)
+	if err != nil {
+		return backends.Metadata{}, nil, err
+	}
+
+	return file.metadata, io.NopCloser(bytes.NewReader(file.data)), nil
+}
+
+func (b MemoryBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	file, err := b.lookup(key, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(io.NewSectionReader(bytes.NewReader(file.data), offset, length)), nil
+}
+
+func (b MemoryBackend) ServeFile(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) error {
+	b.mu.Lock()
+	file, err := b.lookup(key, true)
+	var data []byte
+	var createdAt time.Time
+	if err == nil {
+		// PutMetadata may replace the metadata while the file is served,
+		// the data itself is never changed
+		data, createdAt = file.data, file.metadata.CreatedAt
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	http.ServeContent(w, r, "", backends.ServeModTime(w, createdAt), bytes.NewReader(data))
+	return nil
+}
+
+func (b MemoryBackend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
+	src := r
+	if b.maxSize > 0 {
+		src = io.LimitReader(r, b.maxSize+1)
+	}
+	data, err := io.ReadAll(src)
+	if len(data) == 0 {
+		return m, backends.FileEmptyError
+	} else if err != nil {
+		return m, err
+	}
+	if b.maxSize > 0 && int64(len(data)) > b.maxSize {
+		return m, FileTooLargeError
+	}
+
+	m, err = helpers.GenerateMetadata(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	m.OriginalName = originalName
+	m.Expiry = expiry
+	m.CreatedAt = time.Now()
+	m.DeleteKey = deleteKey
+	m.AccessKey = accessKey
+	m.Encoding = backends.EncodingOf(ctx)
+	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, bytes.NewReader(data))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elem, ok := b.files[key]; ok {
+		b.remove(elem)
+	}
+	for b.maxSize > 0 && *b.used+int64(len(data)) > b.maxSize {
+		b.remove(b.lru.Back())
+	}
+
+	b.files[key] = b.lru.PushFront(&memoryFile{key: key, data: data, metadata: m})
+	*b.used += int64(len(data))
+
+	return m, nil
+}
+
+func (b MemoryBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	file, err := b.lookup(key, false)
+	if err != nil {
+		return err
+	}
+	file.metadata = m
+
+	return nil
+}
+
+func (b MemoryBackend) Size(ctx context.Context, key string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	file, err := b.lookup(key, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(file.data)), nil
+}
+
+func (b MemoryBackend) List(ctx context.Context) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	output := make([]string, 0, len(b.files))
+	for key := range b.files {
+		output = append(output, key)
+	}
+
+	return output, nil
+}
+
+// NewMemoryBackend creates an empty in-memory backend. A maxSize of 0 means
+// files are never evicted.
+func NewMemoryBackend(maxSize int64) MemoryBackend {
+	return MemoryBackend{
+		mu:      &sync.Mutex{},
+		files:   make(map[string]*list.Element),
+		lru:     list.New(),
+		used:    new(int64),
+		maxSize: maxSize,
+	}
+}
@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func put(t *testing.T, b MemoryBackend, key, content string) {
+	_, err := b.Put(context.Background(), key, key, strings.NewReader(content), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend(0)
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("0123456789"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, r, err := b.Get(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	if string(data) != "0123456789" || metadata.DeleteKey != "del" || metadata.Size != 10 {
+		t.Fatalf("Stored file is '%s' with %+v", data, metadata)
+	}
+
+	req := httptest.NewRequest("GET", "/a.txt", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	w := httptest.NewRecorder()
+	err = b.ServeFile(ctx, "a.txt", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Fatalf("Range request returned %d '%s'", w.Code, w.Body.String())
+	}
+
+	err = b.Delete(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutMetadata(ctx, "a.txt", metadata)
+	if err != backends.NotFoundErr {
+		t.Fatalf("PutMetadata of a deleted file returned %v", err)
+	}
+}
+
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend(25)
+
+	put(t, b, "a.txt", "0123456789")
+	put(t, b, "b.txt", "0123456789")
+	// reading a.txt makes b.txt the least recently used
+	_, r, err := b.Get(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	put(t, b, "c.txt", "0123456789")
+
+	for key, expected := range map[string]bool{"a.txt": true, "b.txt": false, "c.txt": true} {
+		if exists, _ := b.Exists(ctx, key); exists != expected {
+			t.Fatalf("%s exists: %v", key, exists)
+		}
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend(10)
+	put(t, b, "a.txt", "0123456789")
+
+	_, err := b.Put(ctx, "b.txt", "b.txt", strings.NewReader("0123456789a"), expiry.NeverExpire, "", "")
+	if err != FileTooLargeError {
+		t.Fatalf("Storing a file over the limit returned %v", err)
+	}
+	if exists, _ := b.Exists(ctx, "a.txt"); !exists {
+		t.Fatal("A file was evicted for an upload that can't be stored")
+	}
+}
+
+func TestServeWhileUpdated(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend(0)
+	put(t, b, "a.txt", "content")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			metadata, err := b.Head(ctx, "a.txt")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			metadata.DeleteKey = "new"
+			b.PutMetadata(ctx, "a.txt", metadata)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		err := b.ServeFile(ctx, "a.txt", w, httptest.NewRequest("GET", "/a.txt", nil))
+		if err != nil || w.Body.String() != "content" {
+			t.Fatalf("Served '%s': %v", w.Body.String(), err)
+		}
+	}
+	<-done
+}
@@ -1,7 +1,9 @@
 package backends
 
 import (
+	"context"
 	"errors"
+	"strings"
 	"time"
 )
 
@@ -14,6 +16,86 @@ type Metadata struct {
 	Size         int64
 	Expiry       time.Time
 	ArchiveFiles []string
+	Encoding     string // Transformations applied to the stored bytes, comma separated in the order they were applied
+
+	CreatedAt      time.Time // zero if unknown
+	LastAccessedAt time.Time // zero if never downloaded, only updated every once in a while
 }
 
 var BadMetadata = errors.New("Corrupted metadata.")
+
+// UnixTime converts a stored timestamp, where 0 means unset
+func UnixTime(ts int64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0)
+}
+
+// UnixTimestamp converts a time for storage, unset times become 0
+func UnixTimestamp(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// PushEncoding records that the stored bytes were additionally transformed
+// with the given encoding.
+func PushEncoding(encoding, token string) string {
+	if encoding == "" {
+		return token
+	}
+	return encoding + "," + token
+}
+
+// PopEncoding removes token from encoding if it was the last transformation
+// applied and reports whether it was.
+func PopEncoding(encoding, token string) (string, bool) {
+	if encoding == token {
+		return "", true
+	}
+	if strings.HasSuffix(encoding, ","+token) {
+		return strings.TrimSuffix(encoding, ","+token), true
+	}
+	return encoding, false
+}
+
+type encodingKey struct{}
+
+// WithEncoding has files put with the returned context stored as encoded
+// with token on top of the encodings already in ctx, so a transformed file
+// is marked as such in the first metadata written for it
+func WithEncoding(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, encodingKey{}, PushEncoding(EncodingOf(ctx), token))
+}
+
+// EncodingOf returns the encoding files put with ctx are stored with
+func EncodingOf(ctx context.Context) string {
+	encoding, _ := ctx.Value(encodingKey{}).(string)
+	return encoding
+}
+
+// MetaStore keeps the metadata of files apart from the files themselves
+type MetaStore interface {
+	Get(ctx context.Context, key string) (Metadata, error)
+	Put(ctx context.Context, key string, m Metadata) error
+	// Update replaces the metadata of a stored file and returns NotFoundErr
+	// if there is none, so deleted files aren't brought back
+	Update(ctx context.Context, key string, m Metadata) error
+	// MarkAccessed records t as the last access of a file unless a later
+	// one is already recorded
+	MarkAccessed(ctx context.Context, key string, t time.Time) error
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context) ([]string, error)
+	Find(ctx context.Context, q MetaQuery) ([]string, error)
+}
+
+// MetaQuery selects files by their metadata, unset fields match every file
+type MetaQuery struct {
+	ExpiredBefore time.Time // files that expire before this time, never expiring files are not matched
+	MinSize       int64
+	MaxSize       int64
+	Mimetype      string
+	Sha256sum     string
+}
@@ -0,0 +1,142 @@
+package metastore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// MetaStoreBackend stores files in the wrapped backend and their metadata in
+// a separate MetaStore, which answers Head, PutMetadata and List on its own.
+type MetaStoreBackend struct {
+	files backends.MetaStorageBackend
+	meta  backends.MetaStore
+}
+
+func (b MetaStoreBackend) Delete(ctx context.Context, key string) error {
+	fileErr := b.files.Delete(ctx, key)
+	if errors.Is(fileErr, backends.NotFoundErr) || errors.Is(fileErr, fs.ErrNotExist) {
+		fileErr = nil
+	}
+
+	return errors.Join(fileErr, b.meta.Delete(ctx, key))
+}
+
+func (b MetaStoreBackend) Exists(ctx context.Context, key string) (bool, error) {
+	return b.files.Exists(ctx, key)
+}
+
+func (b MetaStoreBackend) Reserve(ctx context.Context, key string) error {
+	return backends.Reserve(ctx, b.files, key)
+}
+
+func (b MetaStoreBackend) Head(ctx context.Context, key string) (backends.Metadata, error) {
+	return b.meta.Get(ctx, key)
+}
+
+func (b MetaStoreBackend) Get(ctx context.Context, key string) (backends.Metadata, io.ReadCloser, error) {
+	metadata, err := b.meta.Get(ctx, key)
+	if err != nil {
+		return metadata, nil, err
+	}
+
+	_, r, err := b.files.Get(ctx, key)
+	return metadata, r, err
+}
+
+func (b MetaStoreBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return backends.GetRange(ctx, b.files, key, offset, length)
+}
+
+func (b MetaStoreBackend) ServeFile(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) error {
+	_, err := b.meta.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return b.files.ServeFile(ctx, key, w, r)
+}
+
+func (b MetaStoreBackend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (backends.Metadata, error) {
+	m, err := b.files.Put(ctx, key, originalName, r, expiry, deleteKey, accessKey)
+	if err != nil {
+		return m, err
+	}
+
+	err = b.meta.Put(ctx, key, m)
+	if err != nil {
+		b.files.Delete(ctx, key)
+		return m, err
+	}
+
+	return m, nil
+}
+
+func (b MetaStoreBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	return b.meta.Update(ctx, key, m)
+}
+
+func (b MetaStoreBackend) MarkAccessed(ctx context.Context, key string, t time.Time) error {
+	return b.meta.MarkAccessed(ctx, key, t)
+}
+
+func (b MetaStoreBackend) Size(ctx context.Context, key string) (int64, error) {
+	return b.files.Size(ctx, key)
+}
+
+func (b MetaStoreBackend) List(ctx context.Context) ([]string, error) {
+	return b.meta.List(ctx)
+}
+
+func (b MetaStoreBackend) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	return b.meta.Find(ctx, backends.MetaQuery{ExpiredBefore: before})
+}
+
+// Find looks up files by their metadata
+func (b MetaStoreBackend) Find(ctx context.Context, q backends.MetaQuery) ([]string, error) {
+	return b.meta.Find(ctx, q)
+}
+
+// Import copies the metadata of files that are missing from the store from
+// another backend, usually the same storage with its old metadata files.
+func (b MetaStoreBackend) Import(ctx context.Context, from backends.MetaStorageBackend) (int, error) {
+	files, err := from.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, key := range files {
+		_, err := b.meta.Get(ctx, key)
+		if err == nil {
+			continue
+		} else if err != backends.NotFoundErr {
+			return imported, err
+		}
+
+		metadata, err := from.Head(ctx, key)
+		if err != nil {
+			continue
+		}
+
+		err = b.meta.Put(ctx, key, metadata)
+		if err != nil {
+			return imported, err
+		}
+		imported++
+	}
+
+	return imported, nil
+}
+
+func NewMetaStoreBackend(files backends.MetaStorageBackend, meta backends.MetaStore) MetaStoreBackend {
+	return MetaStoreBackend{
+		files: files,
+		meta:  meta,
+	}
+}
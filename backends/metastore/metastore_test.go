@@ -0,0 +1,101 @@
+package metastore
+
+import (
+	"context"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/backends/sqlite"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func newTestBackend(t *testing.T) (MetaStoreBackend, memory.MemoryBackend) {
+	store, err := sqlite.NewSqliteMetaStore(path.Join(t.TempDir(), "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	files := memory.NewMemoryBackend(0)
+	return NewMetaStoreBackend(files, store), files
+}
+
+func TestMetadataInStore(t *testing.T) {
+	ctx := context.Background()
+	b, files := newTestBackend(t)
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := b.Head(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.DeleteKey != "del" || metadata.Size != 7 {
+		t.Fatalf("Stored metadata is %+v", metadata)
+	}
+
+	metadata.DeleteKey = "new"
+	err = b.PutMetadata(ctx, "a.txt", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata, _ := b.Head(ctx, "a.txt"); metadata.DeleteKey != "new" {
+		t.Fatal("PutMetadata did not update the store")
+	}
+	if metadata, _ := files.Head(ctx, "a.txt"); metadata.DeleteKey != "del" {
+		t.Fatal("PutMetadata changed the file backend")
+	}
+}
+
+func TestPutMetadataAfterDelete(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestBackend(t)
+
+	metadata, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Delete(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.PutMetadata(ctx, "a.txt", metadata)
+	if err != backends.NotFoundErr {
+		t.Fatalf("PutMetadata of a deleted file returned %v", err)
+	}
+	if files, _ := b.List(ctx); len(files) != 0 {
+		t.Fatalf("Deleted file is listed again: %v", files)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	b, files := newTestBackend(t)
+
+	_, err := files.Put(ctx, "old.txt", "old.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put(ctx, "new.txt", "new.txt", strings.NewReader("content"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := b.Import(ctx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 1 {
+		t.Fatalf("Imported %d files instead of 1", imported)
+	}
+	if metadata, err := b.Head(ctx, "old.txt"); err != nil || metadata.DeleteKey != "del" {
+		t.Fatal("Metadata of the old file was not imported")
+	}
+}
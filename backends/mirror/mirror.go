@@ -0,0 +1,359 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+// MirrorBackend writes every file to all of its replicas and reads from the
+// first replica that can serve it.
+type MirrorBackend struct {
+	replicas []backends.MetaStorageBackend
+}
+
+// eachReplica runs fn on every replica and only fails if it failed everywhere
+func (b MirrorBackend) eachReplica(fn func(replica backends.MetaStorageBackend) error) error {
+	var errs []error
+	for _, replica := range b.replicas {
+		err := fn(replica)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == len(b.replicas) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Delete only succeeds once the file is gone from every replica, otherwise
+// Repair would copy it back from a replica that kept it
+func (b MirrorBackend) Delete(ctx context.Context, key string) error {
+	var errs []error
+	deleted := false
+	for _, replica := range b.replicas {
+		err := replica.Delete(ctx, key)
+		if err == nil {
+			deleted = true
+		} else if !errors.Is(err, backends.NotFoundErr) && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	} else if !deleted {
+		return backends.NotFoundErr
+	}
+	return nil
+}
+
+func (b MirrorBackend) Exists(ctx context.Context, key string) (exists bool, err error) {
+	for _, replica := range b.replicas {
+		exists, err = replica.Exists(ctx, key)
+		if err == nil && exists {
+			return
+		}
+	}
+	return
+}
+
+// Reserve claims the name on every replica, so it can't be taken on any of
+// them while the upload is stored and copied
+func (b MirrorBackend) Reserve(ctx context.Context, key string) error {
+	var reserved []backends.MetaStorageBackend
+	var errs []error
+	for _, replica := range b.replicas {
+		err := backends.Reserve(ctx, replica, key)
+		if err == backends.FileExistsErr {
+			for _, r := range reserved {
+				r.Delete(ctx, key)
+			}
+			return err
+		} else if err != nil {
+			errs = append(errs, err)
+		} else {
+			reserved = append(reserved, replica)
+		}
+	}
+
+	if len(reserved) == 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func (b MirrorBackend) Head(ctx context.Context, key string) (metadata backends.Metadata, err error) {
+	for _, replica := range b.replicas {
+		metadata, err = replica.Head(ctx, key)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (b MirrorBackend) Get(ctx context.Context, key string) (metadata backends.Metadata, r io.ReadCloser, err error) {
+	for _, replica := range b.replicas {
+		metadata, r, err = replica.Get(ctx, key)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (b MirrorBackend) GetRange(ctx context.Context, key string, offset, length int64) (r io.ReadCloser, err error) {
+	for _, replica := range b.replicas {
+		r, err = backends.GetRange(ctx, replica, key, offset, length)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (b MirrorBackend) ServeFile(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) (err error) {
+	for _, replica := range b.replicas {
+		tw := &trackingWriter{ResponseWriter: w}
+		err = replica.ServeFile(ctx, key, tw, r)
+		// once something was sent the next replica can't take over
+		if err == nil || tw.written {
+			return
+		}
+	}
+	return
+}
+
+func (b MirrorBackend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
+	// the upload can only be read once, so it is stored on the first
+	// replica that accepts it and copied from there to the others
+	counter := &countingReader{r: r}
+	source := -1
+	for i, replica := range b.replicas {
+		m, err = replica.Put(ctx, key, originalName, counter, expiry, deleteKey, accessKey)
+		if err == nil {
+			source = i
+			break
+		}
+		if err == backends.FileEmptyError {
+			return
+		}
+		log.Printf("Failed to store %s on replica %d: %v", key, i, err)
+		// the next replica would only get the rest of the upload
+		if counter.n > 0 {
+			return
+		}
+	}
+	if source == -1 {
+		return
+	}
+
+	for i, replica := range b.replicas {
+		if i == source {
+			continue
+		}
+		copyErr := backends.Copy(ctx, key, b.replicas[source], replica)
+		if copyErr != nil {
+			log.Printf("Failed to copy %s to replica %d: %v", key, i, copyErr)
+		}
+	}
+
+	return
+}
+
+// PutMetadata only succeeds once every replica holding the file has the new
+// metadata, replicas missing the file get it with the file from Repair
+func (b MirrorBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	var errs []error
+	stored := false
+	for _, replica := range b.replicas {
+		err := replica.PutMetadata(ctx, key, m)
+		if err == nil {
+			stored = true
+		} else if !errors.Is(err, backends.NotFoundErr) {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	} else if !stored {
+		return backends.NotFoundErr
+	}
+	return nil
+}
+
+func (b MirrorBackend) Size(ctx context.Context, key string) (size int64, err error) {
+	for _, replica := range b.replicas {
+		size, err = replica.Size(ctx, key)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (b MirrorBackend) List(ctx context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	var output []string
+
+	err := b.eachReplica(func(replica backends.MetaStorageBackend) error {
+		files, err := replica.List(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range files {
+			if !seen[name] {
+				seen[name] = true
+				output = append(output, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// Repair copies files that are missing on a replica from one that has them.
+// The first replica holding a file also has the right metadata, it replaces
+// metadata that differs on the others.
+func (b MirrorBackend) Repair(ctx context.Context, noLogs bool) error {
+	files, err := b.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range files {
+		source := -1
+		var sourceMetadata backends.Metadata
+		var missing, diverged []int
+		for i, replica := range b.replicas {
+			metadata, err := replica.Head(ctx, key)
+			if err == nil && source == -1 {
+				// expired files are left for the cleanup to remove
+				if expiry.IsTsExpired(metadata.Expiry) {
+					break
+				}
+				source = i
+				sourceMetadata = metadata
+			} else if err == nil && !sameMetadata(metadata, sourceMetadata) {
+				diverged = append(diverged, i)
+			} else if err == backends.NotFoundErr {
+				missing = append(missing, i)
+			}
+		}
+		if source == -1 {
+			continue
+		}
+
+		for _, i := range diverged {
+			err := b.replicas[i].PutMetadata(ctx, key, sourceMetadata)
+			if noLogs {
+				continue
+			}
+			if err != nil {
+				log.Printf("Failed to repair the metadata of %s on replica %d: %v", key, i, err)
+			} else {
+				log.Printf("Repaired the metadata of %s on replica %d", key, i)
+			}
+		}
+
+		for _, i := range missing {
+			err := backends.Copy(ctx, key, b.replicas[source], b.replicas[i])
+			if noLogs {
+				continue
+			}
+			if err != nil {
+				log.Printf("Failed to repair %s on replica %d: %v", key, i, err)
+			} else {
+				log.Printf("Repaired %s on replica %d", key, i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// sameMetadata compares metadata apart from the access time, which every
+// replica records on its own
+func sameMetadata(a, b backends.Metadata) bool {
+	a.LastAccessedAt, b.LastAccessedAt = time.Time{}, time.Time{}
+	encodedA, errA := backends.EncodeMetadata(a)
+	encodedB, errB := backends.EncodeMetadata(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+func (b MirrorBackend) PeriodicRepair(interval time.Duration, noLogs bool) {
+	c := time.Tick(interval)
+	for range c {
+		err := b.Repair(context.Background(), noLogs)
+		if err != nil && !noLogs {
+			log.Printf("Replica repair failed: %v", err)
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// trackingWriter records whether a response was started
+type trackingWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *trackingWriter) WriteHeader(code int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *trackingWriter) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps sendfile and other fast paths of the response writer
+func (w *trackingWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.written = true
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *trackingWriter) Flush() {
+	w.written = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *trackingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func NewMirrorBackend(replicas []backends.MetaStorageBackend) MirrorBackend {
+	return MirrorBackend{replicas: replicas}
+}
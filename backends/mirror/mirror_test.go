@@ -0,0 +1,274 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+var errBroken = errors.New("broken replica")
+
+// brokenReplica reads the first readBytes of an upload before failing and
+// can't delete files
+type brokenReplica struct {
+	memory.MemoryBackend
+	readBytes int64
+}
+
+func (b brokenReplica) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (backends.Metadata, error) {
+	io.CopyN(io.Discard, r, b.readBytes)
+	return backends.Metadata{}, errBroken
+}
+
+func (b brokenReplica) Delete(ctx context.Context, key string) error {
+	return errBroken
+}
+
+func (b brokenReplica) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	return errBroken
+}
+
+func read(t *testing.T, b backends.StorageBackend, key string) string {
+	_, r, err := b.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPutCopiesToEveryReplica(t *testing.T) {
+	ctx := context.Background()
+	replicas := []backends.MetaStorageBackend{memory.NewMemoryBackend(0), memory.NewMemoryBackend(0)}
+	b := NewMirrorBackend(replicas)
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("0123456789"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, replica := range replicas {
+		if content := read(t, replica, "a.txt"); content != "0123456789" {
+			t.Fatalf("Replica %d has content '%s'", i, content)
+		}
+	}
+}
+
+func TestPutAfterUnreadFailure(t *testing.T) {
+	ctx := context.Background()
+	good := memory.NewMemoryBackend(0)
+	b := NewMirrorBackend([]backends.MetaStorageBackend{brokenReplica{memory.NewMemoryBackend(0), 0}, good})
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("0123456789"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := read(t, good, "a.txt"); content != "0123456789" {
+		t.Fatalf("Replica has content '%s'", content)
+	}
+}
+
+func TestPutAfterPartialRead(t *testing.T) {
+	ctx := context.Background()
+	good := memory.NewMemoryBackend(0)
+	b := NewMirrorBackend([]backends.MetaStorageBackend{brokenReplica{memory.NewMemoryBackend(0), 4}, good})
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("0123456789"), expiry.NeverExpire, "", "")
+	if err == nil {
+		t.Fatal("Put succeeded with a partially read upload")
+	}
+	if exists, _ := good.Exists(ctx, "a.txt"); exists {
+		t.Fatal("A truncated upload was stored")
+	}
+}
+
+func TestDeleteEverywhere(t *testing.T) {
+	ctx := context.Background()
+	first := memory.NewMemoryBackend(0)
+	second := memory.NewMemoryBackend(0)
+	b := NewMirrorBackend([]backends.MetaStorageBackend{first, second})
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// missing on a replica counts as deleted there
+	second.Delete(ctx, "a.txt")
+
+	err = b.Delete(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Repair(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := b.Exists(ctx, "a.txt"); exists {
+		t.Fatal("Deleted file came back")
+	}
+
+	err = b.Delete(ctx, "a.txt")
+	if err != backends.NotFoundErr {
+		t.Fatalf("Deleting a missing file returned %v", err)
+	}
+}
+
+func TestDeleteFailsOnAnyReplica(t *testing.T) {
+	ctx := context.Background()
+	good := memory.NewMemoryBackend(0)
+	broken := brokenReplica{memory.NewMemoryBackend(0), 0}
+	b := NewMirrorBackend([]backends.MetaStorageBackend{good, broken})
+
+	for _, replica := range []backends.StorageBackend{good, broken.MemoryBackend} {
+		_, err := replica.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := b.Delete(ctx, "a.txt")
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("Delete returned %v although a replica kept the file", err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	first := memory.NewMemoryBackend(0)
+	second := memory.NewMemoryBackend(0)
+	b := NewMirrorBackend([]backends.MetaStorageBackend{first, second})
+
+	_, err := first.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = first.Put(ctx, "expired.txt", "expired.txt", strings.NewReader("content"), time.Now().Add(-time.Minute), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Repair(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content := read(t, second, "a.txt"); content != "content" {
+		t.Fatalf("Repaired file has content '%s'", content)
+	}
+	if metadata, _ := second.Head(ctx, "a.txt"); metadata.DeleteKey != "del" {
+		t.Fatal("Repair did not keep the metadata")
+	}
+	if exists, _ := second.Exists(ctx, "expired.txt"); exists {
+		t.Fatal("Expired file was repaired")
+	}
+}
+
+func TestPutMetadataFailsOnAnyReplica(t *testing.T) {
+	ctx := context.Background()
+	first := memory.NewMemoryBackend(0)
+	broken := brokenReplica{MemoryBackend: memory.NewMemoryBackend(0)}
+	b := NewMirrorBackend([]backends.MetaStorageBackend{first, broken})
+
+	m, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.DeleteKey = "new"
+	err = b.PutMetadata(ctx, "a.txt", m)
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("PutMetadata with a broken replica returned %v", err)
+	}
+
+	// replicas without the file don't count
+	only := memory.NewMemoryBackend(0)
+	b = NewMirrorBackend([]backends.MetaStorageBackend{only, memory.NewMemoryBackend(0)})
+	m, err = only.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutMetadata(ctx, "a.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutMetadata(ctx, "missing.txt", m)
+	if err != backends.NotFoundErr {
+		t.Fatalf("PutMetadata of a missing file returned %v", err)
+	}
+}
+
+func TestRepairMetadata(t *testing.T) {
+	ctx := context.Background()
+	first := memory.NewMemoryBackend(0)
+	second := memory.NewMemoryBackend(0)
+	b := NewMirrorBackend([]backends.MetaStorageBackend{first, second})
+
+	m, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.DeleteKey = "new"
+	m.Expiry = time.Now().Add(time.Hour).Truncate(time.Second)
+	err = first.PutMetadata(ctx, "a.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Repair(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := second.Head(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.DeleteKey != "new" || !metadata.Expiry.Equal(m.Expiry) {
+		t.Fatalf("Diverged metadata was not repaired: %+v", metadata)
+	}
+}
+
+// readerFromRecorder records whether a response was sent with ReadFrom
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestTrackingWriterForwards(t *testing.T) {
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	var w http.ResponseWriter = &trackingWriter{ResponseWriter: rec}
+
+	_, err := w.(io.ReaderFrom).ReadFrom(strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.readFrom {
+		t.Fatal("ReadFrom of the response writer was not used")
+	}
+	if !w.(*trackingWriter).written {
+		t.Fatal("Response was not tracked")
+	}
+
+	w.(http.Flusher).Flush()
+	if !rec.Flushed {
+		t.Fatal("Flush was not forwarded")
+	}
+}
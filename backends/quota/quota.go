@@ -0,0 +1,549 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+// Eviction policies, deciding which files make room for new uploads
+const (
+	EvictExpiry  = "expiry"  // files that expire soonest, never expiring files last
+	EvictLRU     = "lru"     // files that were least recently downloaded
+	EvictLargest = "largest" // largest files
+	EvictReject  = "reject"  // nothing, the upload is rejected instead
+)
+
+var QuotaExceededError = errors.New("storage quota exceeded")
+var InvalidPolicyError = errors.New("invalid eviction policy")
+
+type fileInfo struct {
+	size       int64
+	expiry     time.Time
+	lastAccess time.Time
+}
+
+type usage struct {
+	mu    sync.Mutex
+	bytes int64
+	files map[string]fileInfo
+	// bytes and number of uploads that are still being stored, they are
+	// reserved so concurrent uploads can't go past the limits together
+	pendingBytes int64
+	pendingFiles int64
+	// sizes of the staged files, kept apart from the others
+	staged        map[string]int64
+	stagedBytes   int64
+	pendingStaged int64
+	// files that were stored or dropped while the usage is resynced
+	changed map[string]bool
+}
+
+// QuotaBackend limits the total size and number of the files stored in the
+// wrapped backend and evicts files according to its policy to stay within
+// the limits. A limit of 0 disables it. Files whose key starts with the
+// staging prefix are never evicted, their total size has a limit of its own
+// and staging files over it are rejected.
+type QuotaBackend struct {
+	base            backends.MetaStorageBackend
+	maxBytes        int64
+	maxFiles        int64
+	policy          string
+	staging         string
+	maxStagingBytes int64
+	noLogs          bool
+	usage           *usage
+}
+
+func (b QuotaBackend) isStaging(key string) bool {
+	return b.staging != "" && strings.HasPrefix(key, b.staging)
+}
+
+type victim struct {
+	key  string
+	info fileInfo
+}
+
+// first returns the file the policy evicts first, skipping the given key.
+// It must be called with the usage lock held.
+func (b QuotaBackend) first(skip string) string {
+	before := func(a, c fileInfo) bool {
+		switch b.policy {
+		case EvictExpiry:
+			if a.expiry == expiry.NeverExpire || c.expiry == expiry.NeverExpire {
+				return c.expiry == expiry.NeverExpire && a.expiry != expiry.NeverExpire
+			}
+			return a.expiry.Before(c.expiry)
+		case EvictLRU:
+			return a.lastAccess.Before(c.lastAccess)
+		default:
+			return a.size > c.size
+		}
+	}
+
+	key := ""
+	for candidate, info := range b.usage.files {
+		if candidate != skip && (key == "" || before(info, b.usage.files[key])) {
+			key = candidate
+		}
+	}
+	return key
+}
+
+// over reports whether the stored files and the uploads in progress go past
+// the limits. It must be called with the usage lock held.
+func (b QuotaBackend) over() bool {
+	return (b.maxBytes > 0 && b.usage.bytes+b.usage.pendingBytes > b.maxBytes) ||
+		(b.maxFiles > 0 && int64(len(b.usage.files))+b.usage.pendingFiles > b.maxFiles)
+}
+
+// pickVictims drops files from the usage until it is within the limits again
+// and returns them to be deleted once the lock is released. It must be called
+// with the usage lock held.
+func (b QuotaBackend) pickVictims(skip string) (victims []victim) {
+	if b.policy == EvictReject {
+		return nil
+	}
+
+	for b.over() {
+		key := b.first(skip)
+		if key == "" {
+			break
+		}
+		victims = append(victims, victim{key: key, info: b.usage.files[key]})
+		b.forget(key)
+	}
+	return
+}
+
+// evict deletes the picked files, those that can't be deleted still count
+func (b QuotaBackend) evict(ctx context.Context, victims []victim) {
+	for _, v := range victims {
+		err := b.base.Delete(ctx, v.key)
+		if err != nil && err != backends.NotFoundErr {
+			b.usage.mu.Lock()
+			b.restore([]victim{v})
+			b.usage.mu.Unlock()
+
+			if !b.noLogs {
+				log.Printf("Failed to evict %s: %v", v.key, err)
+			}
+			continue
+		}
+
+		if !b.noLogs {
+			log.Printf("Evicted %s to stay within the storage quota", v.key)
+		}
+	}
+}
+
+// restore counts picked files again that weren't deleted after all, with
+// the usage lock held
+func (b QuotaBackend) restore(victims []victim) {
+	for _, v := range victims {
+		if _, ok := b.usage.files[v.key]; !ok {
+			b.add(v.key, v.info)
+		}
+	}
+}
+
+// add counts a stored file, with the usage lock held
+func (b QuotaBackend) add(key string, info fileInfo) {
+	b.usage.bytes += info.size
+	b.usage.files[key] = info
+	if b.usage.changed != nil {
+		b.usage.changed[key] = true
+	}
+}
+
+// forget drops a file from the usage, with the usage lock held
+func (b QuotaBackend) forget(key string) {
+	if info, ok := b.usage.files[key]; ok {
+		b.usage.bytes -= info.size
+		delete(b.usage.files, key)
+	}
+	if size, ok := b.usage.staged[key]; ok {
+		b.usage.stagedBytes -= size
+		delete(b.usage.staged, key)
+	}
+	if b.usage.changed != nil {
+		b.usage.changed[key] = true
+	}
+}
+
+// claim reserves n more bytes for the upload of key, which has read total
+// bytes so far, and returns the files to evict to make room for them.
+// Uploads larger than the whole quota are rejected right away, so are
+// uploads that don't fit once nothing is left to evict.
+func (b QuotaBackend) claim(key string, n, total int64) ([]victim, error) {
+	if b.maxBytes > 0 && total > b.maxBytes {
+		return nil, QuotaExceededError
+	}
+
+	b.usage.mu.Lock()
+	defer b.usage.mu.Unlock()
+
+	b.usage.pendingBytes += n
+	if b.maxBytes == 0 || b.usage.bytes+b.usage.pendingBytes <= b.maxBytes {
+		return nil, nil
+	}
+
+	victims := b.pickVictims(key)
+	if b.over() {
+		// the rest is reserved by other uploads
+		b.restore(victims)
+		b.usage.pendingBytes -= n
+		return nil, QuotaExceededError
+	}
+	return victims, nil
+}
+
+// claimStaged reserves n more bytes for a staged file, which has read total
+// bytes so far. Nothing is evicted for staged files.
+func (b QuotaBackend) claimStaged(n, total int64) error {
+	if b.maxStagingBytes > 0 && total > b.maxStagingBytes {
+		return QuotaExceededError
+	}
+
+	b.usage.mu.Lock()
+	defer b.usage.mu.Unlock()
+
+	if b.maxStagingBytes > 0 && b.usage.stagedBytes+b.usage.pendingStaged+n > b.maxStagingBytes {
+		return QuotaExceededError
+	}
+	b.usage.pendingStaged += n
+	return nil
+}
+
+func (b QuotaBackend) touch(key string) {
+	b.usage.mu.Lock()
+	defer b.usage.mu.Unlock()
+
+	if info, ok := b.usage.files[key]; ok {
+		info.lastAccess = time.Now()
+		b.usage.files[key] = info
+	}
+}
+
+func (b QuotaBackend) Delete(ctx context.Context, key string) error {
+	err := b.base.Delete(ctx, key)
+
+	b.usage.mu.Lock()
+	b.forget(key)
+	b.usage.mu.Unlock()
+
+	return err
+}
+
+func (b QuotaBackend) Exists(ctx context.Context, key string) (bool, error) {
+	return b.base.Exists(ctx, key)
+}
+
+func (b QuotaBackend) Reserve(ctx context.Context, key string) error {
+	return backends.Reserve(ctx, b.base, key)
+}
+
+func (b QuotaBackend) Head(ctx context.Context, key string) (backends.Metadata, error) {
+	return b.base.Head(ctx, key)
+}
+
+func (b QuotaBackend) Get(ctx context.Context, key string) (backends.Metadata, io.ReadCloser, error) {
+	b.touch(key)
+	return b.base.Get(ctx, key)
+}
+
+func (b QuotaBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	b.touch(key)
+	return backends.GetRange(ctx, b.base, key, offset, length)
+}
+
+func (b QuotaBackend) ServeFile(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) error {
+	b.touch(key)
+	return b.base.ServeFile(ctx, key, w, r)
+}
+
+func (b QuotaBackend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
+	if b.isStaging(key) {
+		return b.putStaged(ctx, key, originalName, r, expiry, deleteKey, accessKey)
+	}
+
+	// readers that know their length are checked before anything is read
+	if lr, ok := r.(interface{ Len() int }); ok && b.maxBytes > 0 && int64(lr.Len()) > b.maxBytes {
+		return m, QuotaExceededError
+	}
+
+	// room is made before the upload is stored, so concurrent uploads
+	// can't go past the limits together
+	b.usage.mu.Lock()
+	_, replaced := b.usage.files[key]
+	if !replaced {
+		b.usage.pendingFiles++
+	}
+	victims := b.pickVictims(key)
+	if b.over() && !replaced {
+		b.restore(victims)
+		b.usage.pendingFiles--
+		b.usage.mu.Unlock()
+		return m, QuotaExceededError
+	}
+	b.usage.mu.Unlock()
+	b.evict(ctx, victims)
+
+	qr := &quotaReader{ctx: ctx, r: r, key: key, backend: b}
+	m, err = b.base.Put(ctx, key, originalName, qr, expiry, deleteKey, accessKey)
+	if qr.err != nil {
+		// the backend may have seen an empty or broken upload instead
+		err = qr.err
+	}
+
+	b.usage.mu.Lock()
+	b.usage.pendingBytes -= qr.n
+	if !replaced {
+		b.usage.pendingFiles--
+	}
+	if err != nil {
+		b.usage.mu.Unlock()
+		return
+	}
+
+	b.forget(key)
+	b.add(key, fileInfo{size: qr.n, expiry: m.Expiry, lastAccess: time.Now()})
+	victims = b.pickVictims(key)
+	b.usage.mu.Unlock()
+
+	b.evict(ctx, victims)
+	return
+}
+
+func (b QuotaBackend) putStaged(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
+	qr := &quotaReader{ctx: ctx, r: r, key: key, backend: b, staged: true}
+	m, err = b.base.Put(ctx, key, originalName, qr, expiry, deleteKey, accessKey)
+	if qr.err != nil {
+		err = qr.err
+	}
+
+	b.usage.mu.Lock()
+	defer b.usage.mu.Unlock()
+
+	b.usage.pendingStaged -= qr.n
+	if err != nil {
+		return
+	}
+
+	b.forget(key)
+	b.usage.staged[key] = qr.n
+	b.usage.stagedBytes += qr.n
+	return
+}
+
+func (b QuotaBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	err := b.base.PutMetadata(ctx, key, m)
+	if err != nil {
+		return err
+	}
+
+	b.usage.mu.Lock()
+	defer b.usage.mu.Unlock()
+
+	if info, ok := b.usage.files[key]; ok {
+		info.expiry = m.Expiry
+		b.usage.files[key] = info
+	}
+	return nil
+}
+
+func (b QuotaBackend) MarkAccessed(ctx context.Context, key string, t time.Time) error {
+	return backends.MarkAccessed(ctx, b.base, key, t)
+}
+
+func (b QuotaBackend) Size(ctx context.Context, key string) (int64, error) {
+	return b.base.Size(ctx, key)
+}
+
+func (b QuotaBackend) List(ctx context.Context) ([]string, error) {
+	return b.base.List(ctx)
+}
+
+func (b QuotaBackend) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	return backends.ListExpired(ctx, b.base, before)
+}
+
+// quotaReader claims quota for the bytes of an upload as they are read
+type quotaReader struct {
+	ctx     context.Context
+	r       io.Reader
+	key     string
+	staged  bool
+	backend QuotaBackend
+	n       int64
+	err     error
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+
+	n, err := q.r.Read(p)
+	if n > 0 && q.staged {
+		if claimErr := q.backend.claimStaged(int64(n), q.n+int64(n)); claimErr != nil {
+			q.err = claimErr
+			return 0, claimErr
+		}
+		q.n += int64(n)
+	} else if n > 0 {
+		victims, claimErr := q.backend.claim(q.key, int64(n), q.n+int64(n))
+		if claimErr != nil {
+			q.err = claimErr
+			return 0, claimErr
+		}
+		q.backend.evict(q.ctx, victims)
+		q.n += int64(n)
+	}
+	return n, err
+}
+
+// scan works out the usage of the stored files and of the staged ones
+func (b QuotaBackend) scan(ctx context.Context) (map[string]fileInfo, map[string]int64, error) {
+	files, err := b.base.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	usage := make(map[string]fileInfo, len(files))
+	staged := make(map[string]int64)
+	for _, key := range files {
+		if b.isStaging(key) {
+			if size, err := b.base.Size(ctx, key); err == nil {
+				staged[key] = size
+			}
+			continue
+		}
+		metadata, err := b.base.Head(ctx, key)
+		if err != nil {
+			continue
+		}
+		size, err := b.base.Size(ctx, key)
+		if err != nil {
+			continue
+		}
+
+		lastAccess := metadata.LastAccessedAt
+		if lastAccess.IsZero() {
+			lastAccess = metadata.CreatedAt
+		}
+		usage[key] = fileInfo{size: size, expiry: metadata.Expiry, lastAccess: lastAccess}
+	}
+
+	return usage, staged, nil
+}
+
+// set replaces the usage with the scanned one, with the usage lock held
+func (b QuotaBackend) set(files map[string]fileInfo, staged map[string]int64) {
+	b.usage.files = files
+	b.usage.bytes = 0
+	for _, info := range files {
+		b.usage.bytes += info.size
+	}
+	b.usage.staged = staged
+	b.usage.stagedBytes = 0
+	for _, size := range staged {
+		b.usage.stagedBytes += size
+	}
+}
+
+// Resync works out the usage from the stored files again, so files that were
+// deleted or stored without this backend, e.g. by linx-cleanup, are no longer
+// counted wrong. Files over the limits are then evicted. Only one resync may
+// run at a time.
+func (b QuotaBackend) Resync(ctx context.Context) error {
+	b.usage.mu.Lock()
+	b.usage.changed = make(map[string]bool)
+	b.usage.mu.Unlock()
+
+	files, staged, err := b.scan(ctx)
+
+	b.usage.mu.Lock()
+	changed := b.usage.changed
+	b.usage.changed = nil
+	if err != nil {
+		b.usage.mu.Unlock()
+		return err
+	}
+
+	// files changed during the scan are known better than what it found
+	for key := range changed {
+		if info, ok := b.usage.files[key]; ok {
+			files[key] = info
+		} else {
+			delete(files, key)
+		}
+		if size, ok := b.usage.staged[key]; ok {
+			staged[key] = size
+		} else {
+			delete(staged, key)
+		}
+	}
+
+	for key, info := range files {
+		// downloads are only recorded here
+		if known, ok := b.usage.files[key]; ok && known.lastAccess.After(info.lastAccess) {
+			info.lastAccess = known.lastAccess
+			files[key] = info
+		}
+	}
+	b.set(files, staged)
+
+	victims := b.pickVictims("")
+	b.usage.mu.Unlock()
+
+	b.evict(ctx, victims)
+	return nil
+}
+
+func (b QuotaBackend) PeriodicResync(interval time.Duration, noLogs bool) {
+	c := time.Tick(interval)
+	for range c {
+		err := b.Resync(context.Background())
+		if err != nil && !noLogs {
+			log.Printf("Quota resync failed: %v", err)
+		}
+	}
+}
+
+// NewQuotaBackend wraps base and works out how much of the quota is already
+// used by the stored files.
+func NewQuotaBackend(base backends.MetaStorageBackend, maxBytes, maxFiles int64, policy, staging string, maxStagingBytes int64, noLogs bool) (QuotaBackend, error) {
+	switch policy {
+	case EvictExpiry, EvictLRU, EvictLargest, EvictReject:
+	default:
+		return QuotaBackend{}, InvalidPolicyError
+	}
+
+	b := QuotaBackend{
+		base:            base,
+		maxBytes:        maxBytes,
+		maxFiles:        maxFiles,
+		policy:          policy,
+		staging:         staging,
+		maxStagingBytes: maxStagingBytes,
+		noLogs:          noLogs,
+		usage:           &usage{files: make(map[string]fileInfo), staged: make(map[string]int64)},
+	}
+
+	files, staged, err := b.scan(context.Background())
+	if err != nil {
+		return b, err
+	}
+	b.set(files, staged)
+
+	return b, nil
+}
@@ -0,0 +1,252 @@
+package quota
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func newTestBackend(t *testing.T, maxBytes, maxFiles int64, policy string) (QuotaBackend, memory.MemoryBackend) {
+	base := memory.NewMemoryBackend(0)
+	b, err := NewQuotaBackend(base, maxBytes, maxFiles, policy, "", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, base
+}
+
+func put(t *testing.T, b backends.StorageBackend, key string, size int, expiry time.Time) {
+	_, err := b.Put(context.Background(), key, key, strings.NewReader(strings.Repeat("a", size)), expiry, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// unsizedReader hides the length of a reader, like a request body
+type unsizedReader struct {
+	io.Reader
+}
+
+func checkStored(t *testing.T, b backends.StorageBackend, expected map[string]bool) {
+	for key, stored := range expected {
+		if exists, _ := b.Exists(context.Background(), key); exists != stored {
+			t.Fatalf("%s is stored: %v", key, exists)
+		}
+	}
+}
+
+func TestEvictionOrder(t *testing.T) {
+	ctx := context.Background()
+	hour := time.Now().Add(time.Hour)
+
+	// each policy evicts a different one of the three stored files
+	for policy, evicted := range map[string]string{
+		EvictExpiry:  "soon.txt",
+		EvictLRU:     "large.txt",
+		EvictLargest: "large.txt",
+	} {
+		b, base := newTestBackend(t, 0, 3, policy)
+		put(t, b, "large.txt", 20, expiry.NeverExpire)
+		put(t, b, "soon.txt", 10, hour)
+		put(t, b, "later.txt", 10, hour.Add(time.Hour))
+		// large.txt is the least recently used
+		for _, key := range []string{"soon.txt", "later.txt"} {
+			_, r, err := b.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Close()
+		}
+
+		put(t, b, "new.txt", 10, expiry.NeverExpire)
+
+		expected := map[string]bool{"large.txt": true, "soon.txt": true, "later.txt": true, "new.txt": true}
+		expected[evicted] = false
+		checkStored(t, base, expected)
+	}
+}
+
+func TestEvictForBytes(t *testing.T) {
+	b, base := newTestBackend(t, 30, 0, EvictLargest)
+	put(t, b, "a.txt", 10, expiry.NeverExpire)
+	put(t, b, "b.txt", 15, expiry.NeverExpire)
+
+	put(t, b, "c.txt", 10, expiry.NeverExpire)
+	checkStored(t, base, map[string]bool{"a.txt": true, "b.txt": false, "c.txt": true})
+
+	// the upload fills the quota by itself
+	put(t, b, "d.txt", 30, expiry.NeverExpire)
+	checkStored(t, base, map[string]bool{"a.txt": false, "c.txt": false, "d.txt": true})
+}
+
+func TestOversizedUpload(t *testing.T) {
+	ctx := context.Background()
+	b, base := newTestBackend(t, 30, 0, EvictExpiry)
+	put(t, b, "a.txt", 10, expiry.NeverExpire)
+	put(t, b, "b.txt", 10, expiry.NeverExpire)
+
+	for _, r := range []io.Reader{
+		strings.NewReader(strings.Repeat("a", 31)),
+		unsizedReader{strings.NewReader(strings.Repeat("a", 31))},
+	} {
+		_, err := b.Put(ctx, "large.txt", "large.txt", r, expiry.NeverExpire, "", "")
+		if err != QuotaExceededError {
+			t.Fatalf("Storing a file larger than the quota returned %v", err)
+		}
+		checkStored(t, base, map[string]bool{"a.txt": true, "b.txt": true, "large.txt": false})
+	}
+
+	// the usage was not changed by the rejected uploads
+	put(t, b, "c.txt", 10, expiry.NeverExpire)
+	checkStored(t, base, map[string]bool{"a.txt": true, "b.txt": true, "c.txt": true})
+}
+
+func TestReject(t *testing.T) {
+	ctx := context.Background()
+	b, base := newTestBackend(t, 30, 2, EvictReject)
+	put(t, b, "a.txt", 20, expiry.NeverExpire)
+
+	_, err := b.Put(ctx, "b.txt", "b.txt", unsizedReader{strings.NewReader(strings.Repeat("a", 11))}, expiry.NeverExpire, "", "")
+	if err != QuotaExceededError {
+		t.Fatalf("Storing a file over the quota returned %v", err)
+	}
+	checkStored(t, base, map[string]bool{"a.txt": true, "b.txt": false})
+
+	put(t, b, "b.txt", 10, expiry.NeverExpire)
+	_, err = b.Put(ctx, "c.txt", "c.txt", strings.NewReader("a"), expiry.NeverExpire, "", "")
+	if err != QuotaExceededError {
+		t.Fatalf("Storing a file over the file limit returned %v", err)
+	}
+	checkStored(t, base, map[string]bool{"a.txt": true, "b.txt": true, "c.txt": false})
+
+	// deleting files makes room again
+	err = b.Delete(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, b, "c.txt", 20, expiry.NeverExpire)
+}
+
+func TestStagingFiles(t *testing.T) {
+	ctx := context.Background()
+	base := memory.NewMemoryBackend(0)
+	put(t, base, "staging-old", 20, expiry.NeverExpire)
+
+	b, err := NewQuotaBackend(base, 30, 2, EvictExpiry, "staging-", 45, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, b, "staging-a", 20, expiry.NeverExpire)
+	put(t, b, "a.txt", 20, time.Now().Add(time.Hour))
+	put(t, b, "b.txt", 10, time.Now().Add(2*time.Hour))
+	checkStored(t, base, map[string]bool{"staging-old": true, "staging-a": true, "a.txt": true, "b.txt": true})
+
+	// only the other files make room
+	put(t, b, "c.txt", 10, expiry.NeverExpire)
+	checkStored(t, base, map[string]bool{"staging-old": true, "staging-a": true, "a.txt": false, "b.txt": true, "c.txt": true})
+
+	// staged files have a limit of their own
+	_, err = b.Put(ctx, "staging-b", "", unsizedReader{strings.NewReader(strings.Repeat("a", 10))}, expiry.NeverExpire, "", "")
+	if err != QuotaExceededError {
+		t.Fatalf("Staging a file over the limit returned %v", err)
+	}
+	checkStored(t, base, map[string]bool{"staging-b": false, "b.txt": true, "c.txt": true})
+
+	err = b.Delete(ctx, "staging-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, b, "staging-b", 10, expiry.NeverExpire)
+	put(t, b, "d.txt", 10, expiry.NeverExpire)
+	checkStored(t, base, map[string]bool{"staging-old": true, "staging-b": true, "b.txt": false, "c.txt": true, "d.txt": true})
+}
+
+func TestExistingFilesCount(t *testing.T) {
+	ctx := context.Background()
+	base := memory.NewMemoryBackend(0)
+	put(t, base, "a.txt", 20, expiry.NeverExpire)
+
+	b, err := NewQuotaBackend(base, 30, 0, EvictReject, "", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put(ctx, "b.txt", "b.txt", strings.NewReader(strings.Repeat("a", 11)), expiry.NeverExpire, "", "")
+	if err != QuotaExceededError {
+		t.Fatalf("Stored files were not counted: %v", err)
+	}
+
+	_, err = NewQuotaBackend(base, 30, 0, "random", "", 0, true)
+	if err != InvalidPolicyError {
+		t.Fatalf("Unknown policy returned %v", err)
+	}
+}
+
+func TestConcurrentUploads(t *testing.T) {
+	ctx := context.Background()
+	b, base := newTestBackend(t, 30, 0, EvictExpiry)
+	put(t, b, "a.txt", 10, time.Now().Add(time.Hour))
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Put(ctx, "b.txt", "b.txt", pr, expiry.NeverExpire, "", "")
+		done <- err
+	}()
+	pw.Write([]byte(strings.Repeat("a", 20)))
+	for {
+		b.usage.mu.Lock()
+		pending := b.usage.pendingBytes
+		b.usage.mu.Unlock()
+		if pending == 20 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// evicting a.txt wouldn't make enough room next to the upload in
+	// progress, so it is kept
+	_, err := b.Put(ctx, "c.txt", "c.txt", unsizedReader{strings.NewReader(strings.Repeat("a", 20))}, expiry.NeverExpire, "", "")
+	if err != QuotaExceededError {
+		t.Fatalf("Storing files over the quota together returned %v", err)
+	}
+	checkStored(t, base, map[string]bool{"a.txt": true, "c.txt": false})
+
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, base, map[string]bool{"a.txt": true, "b.txt": true})
+
+	// a.txt is evicted before the next upload is stored
+	put(t, b, "d.txt", 5, expiry.NeverExpire)
+	checkStored(t, base, map[string]bool{"a.txt": false, "b.txt": true, "d.txt": true})
+}
+
+func TestResync(t *testing.T) {
+	ctx := context.Background()
+	b, base := newTestBackend(t, 30, 0, EvictLargest)
+	put(t, b, "a.txt", 10, expiry.NeverExpire)
+	put(t, b, "b.txt", 10, expiry.NeverExpire)
+
+	// files changed behind the quota's back
+	err := base.Delete(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, base, "c.txt", 25, expiry.NeverExpire)
+
+	err = b.Resync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, base, map[string]bool{"b.txt": true, "c.txt": false})
+	if b.usage.bytes != 10 || len(b.usage.files) != 1 {
+		t.Fatalf("Usage is %d bytes in %d files after resync", b.usage.bytes, len(b.usage.files))
+	}
+}
@@ -1,37 +1,76 @@
 package s3
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/andreimarcu/linx-server/backends"
 	"github.com/andreimarcu/linx-server/helpers"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// metaPrefix holds a JSON sidecar object with the full metadata of every file,
+// since object metadata is limited in size and can only be changed by copying
+// the whole object. Filenames never contain a slash, so they can't collide.
+const metaPrefix = ".meta/"
+
+// sidecarMarker is set in the object metadata of files with a sidecar. An
+// object with the marker but without its sidecar is still being stored or
+// deleted, rather than a file from before sidecars.
+const sidecarMarker = "sidecar"
+
+func isNotFound(err error) bool {
+	var nsk *types.NoSuchKey
+	var nf *types.NotFound
+	return errors.As(err, &nsk) || errors.As(err, &nf)
+}
+
+// isConflict reports whether a conditional write failed because the object
+// was changed or deleted in the meantime
+func isConflict(err error) bool {
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		switch re.HTTPStatusCode() {
+		case http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed:
+			return true
+		}
+	}
+	return false
+}
+
 type S3Backend struct {
-	bucket string
-	svc    *s3.Client
+	bucket        string
+	svc           *s3.Client
+	presignExpiry time.Duration
 }
 
+// Delete removes the sidecar first, the object is no longer served without it
 func (b S3Backend) Delete(ctx context.Context, key string) error {
 	_, err := b.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(b.bucket),
-		Key:    aws.String(key),
+		Key:    aws.String(metaPrefix + key),
 	})
 	if err != nil {
 		return err
 	}
-	return nil
+
+	_, err = b.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	return err
 }
 
 func (b S3Backend) Exists(ctx context.Context, key string) (bool, error) {
@@ -39,13 +78,27 @@ func (b S3Backend) Exists(ctx context.Context, key string) (bool, error) {
 		Bucket: aws.String(b.bucket),
 		Key:    aws.String(key),
 	})
-	return err == nil, err
+	if err != nil {
+		var nsk *types.NoSuchKey
+		var nf *types.NotFound
+		if errors.As(err, &nsk) || errors.As(err, &nf) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
 }
 
 func (b S3Backend) Head(ctx context.Context, key string) (metadata backends.Metadata, err error) {
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
+	metadata, err = b.getSidecar(ctx, key)
+	if err != backends.NotFoundErr {
+		return
+	}
+
+	// files stored before sidecars were introduced only have object metadata
 	var result *s3.HeadObjectOutput
 	result, err = b.svc.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(b.bucket),
@@ -59,8 +112,12 @@ func (b S3Backend) Head(ctx context.Context, key string) (metadata backends.Meta
 		}
 		return
 	}
+	if _, ok := result.Metadata[sidecarMarker]; ok {
+		return metadata, backends.NotFoundErr
+	}
 
 	metadata, err = unmapMetadata(result.Metadata)
+	metadata.CreatedAt = aws.ToTime(result.LastModified)
 	return
 }
 
@@ -79,151 +136,261 @@ func (b S3Backend) Get(ctx context.Context, key string) (metadata backends.Metad
 		return
 	}
 
-	metadata, err = unmapMetadata(result.Metadata)
+	metadata, err = b.getSidecar(ctx, key)
+	if _, marked := result.Metadata[sidecarMarker]; err == backends.NotFoundErr && !marked {
+		metadata, err = unmapMetadata(result.Metadata)
+		metadata.CreatedAt = aws.ToTime(result.LastModified)
+	}
+	if err != nil {
+		result.Body.Close()
+		return
+	}
+
 	r = result.Body
 	return
 }
 
-func (b S3Backend) ServeFile(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) (err error) {
-	var result *s3.GetObjectOutput
-
-	if r.Header.Get("Range") != "" {
-		result, err = b.svc.GetObject(ctx, &s3.GetObjectInput{
-			Bucket: aws.String(b.bucket),
-			Key:    aws.String(key),
-			Range:  aws.String(r.Header.Get("Range")),
-		})
-
-		w.WriteHeader(206)
-		w.Header().Set("Content-Range", *result.ContentRange)
-		w.Header().Set("Content-Length", strconv.FormatInt(*result.ContentLength, 10))
-		w.Header().Set("Accept-Ranges", "bytes")
+func (b S3Backend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	result, err := b.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		var nf *types.NotFound
+		if errors.As(err, &nsk) || errors.As(err, &nf) {
+			err = backends.NotFoundErr
+		}
+		return nil, err
+	}
 
-	} else {
-		result, err = b.svc.GetObject(ctx, &s3.GetObjectInput{
-			Bucket: aws.String(b.bucket),
-			Key:    aws.String(key),
-		})
+	return result.Body, nil
+}
 
+func (b S3Backend) ServeFile(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) error {
+	if b.presignExpiry > 0 {
+		return b.redirectToPresigned(ctx, key, w, r)
 	}
 
+	result, err := b.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
 		var nsk *types.NoSuchKey
 		var nf *types.NotFound
 		if errors.As(err, &nsk) || errors.As(err, &nf) {
 			err = backends.NotFoundErr
 		}
-		return
+		return err
 	}
 
-	_, err = io.Copy(w, result.Body)
+	// ServeContent takes care of ranges and conditional requests the same
+	// way http.ServeFile does for localfs, fetching only the requested bytes
+	object := &objectReader{ctx: ctx, backend: b, key: key, size: aws.ToInt64(result.ContentLength)}
+	defer object.Close()
 
-	return
+	http.ServeContent(w, r, "", backends.ServeModTime(w, aws.ToTime(result.LastModified)), object)
+	return nil
 }
 
-func mapMetadata(m backends.Metadata) map[string]string {
-	return map[string]string{
-		"OriginalName": m.OriginalName,
-		"Expiry":       strconv.FormatInt(m.Expiry.Unix(), 10),
-		"Deletekey":    m.DeleteKey,
-		"Size":         strconv.FormatInt(m.Size, 10),
-		"Mimetype":     m.Mimetype,
-		"Sha256sum":    m.Sha256sum,
-		"AccessKey":    m.AccessKey,
+// redirectToPresigned sends the client to a short-lived presigned URL of the
+// object, which serves it with the headers already set for the response
+func (b S3Backend) redirectToPresigned(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "" {
+		input.ResponseContentType = aws.String(contentType)
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != "" {
+		input.ResponseContentDisposition = aws.String(disposition)
 	}
-}
 
-func unmapMetadata(input map[string]string) (m backends.Metadata, err error) {
-	expiry, err := strconv.ParseInt(input["Expiry"], 10, 64)
+	presigned, err := s3.NewPresignClient(b.svc).PresignGetObject(ctx, input, s3.WithPresignExpires(b.presignExpiry))
 	if err != nil {
-		return m, err
+		return err
 	}
-	m.Expiry = time.Unix(expiry, 0)
 
-	m.Size, err = strconv.ParseInt(input["Size"], 10, 64)
+	for _, header := range []string{"Content-Type", "Content-Disposition", "Content-Length", "Etag"} {
+		w.Header().Del(header)
+	}
+	// the URL stops working after a while, so the redirect can't be cached
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	http.Redirect(w, r, presigned.URL, http.StatusFound)
+	return nil
+}
+
+func (b S3Backend) getSidecar(ctx context.Context, key string) (m backends.Metadata, err error) {
+	result, err := b.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(metaPrefix + key),
+	})
 	if err != nil {
+		var nsk *types.NoSuchKey
+		var nf *types.NotFound
+		if errors.As(err, &nsk) || errors.As(err, &nf) {
+			err = backends.NotFoundErr
+		}
 		return
 	}
+	defer result.Body.Close()
 
-	m.DeleteKey = input["Deletekey"]
-	if m.DeleteKey == "" {
-		m.DeleteKey = input["Delete_key"]
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return
 	}
 
-	m.OriginalName = input["OriginalName"]
-	m.Mimetype = input["Mimetype"]
-	m.Sha256sum = input["Sha256sum"]
-
-	if key, ok := input["AccessKey"]; ok {
-		m.AccessKey = key
-	}
-	return
+	return backends.DecodeMetadata(data)
 }
 
-func (b S3Backend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
-	tmpDst, err := os.CreateTemp("", "linx-server-upload")
+// putSidecar writes the sidecar of key. With a condition, the write fails
+// if the sidecar was changed in the meantime.
+func (b S3Backend) putSidecar(ctx context.Context, key string, m backends.Metadata, condition func(*s3.PutObjectInput)) error {
+	data, err := backends.EncodeMetadata(m)
 	if err != nil {
-		return m, err
+		return err
 	}
-	defer tmpDst.Close()
-	defer os.Remove(tmpDst.Name())
 
-	bytes, err := io.Copy(tmpDst, r)
-	if bytes == 0 {
-		return m, backends.FileEmptyError
-	} else if err != nil {
-		return m, err
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(metaPrefix + key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}
+	if condition != nil {
+		condition(input)
 	}
+	_, err = b.svc.PutObject(ctx, input)
+	return err
+}
 
-	_, err = tmpDst.Seek(0, 0)
-	if err != nil {
-		return m, err
+// unmapMetadata reads the object metadata of files stored before sidecar
+// objects, linx-upgrade-metadata moves it into a sidecar. It is upgraded like
+// any other metadata without a version.
+func unmapMetadata(metadata map[string]string) (m backends.Metadata, err error) {
+	// S3 doesn't keep the case of metadata keys and the SDK returns them
+	// in lower case
+	record := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		record[strings.ToLower(key)] = value
+	}
+	if _, ok := record["expiry"]; !ok {
+		return m, backends.BadMetadata
 	}
 
-	m, err = helpers.GenerateMetadata(tmpDst)
+	data, err := json.Marshal(record)
 	if err != nil {
 		return
 	}
-	m.OriginalName = originalName
-	m.Expiry = expiry
-	m.DeleteKey = deleteKey
-	m.AccessKey = accessKey
-	// XXX: we may not be able to write this to AWS easily
-	// m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, tmpDst)
+	return backends.DecodeMetadata(data)
+}
 
-	_, err = tmpDst.Seek(0, 0)
-	if err != nil {
+func (b S3Backend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
+	// the upload is hashed and sniffed while it streams to S3, its metadata
+	// only goes into the sidecar once everything has been read
+	mr := helpers.NewMetadataReader(r)
+	header := make([]byte, helpers.MimetypeDetectLimit)
+	n, err := io.ReadFull(mr, header)
+	if n == 0 && (err == nil || err == io.EOF) {
+		return m, backends.FileEmptyError
+	} else if err != nil && err != io.ErrUnexpectedEOF {
 		return m, err
 	}
 
 	uploader := manager.NewUploader(b.svc)
-	input := &s3.PutObjectInput{
+	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
 		Bucket:   aws.String(b.bucket),
 		Key:      aws.String(key),
-		Body:     tmpDst,
-		Metadata: mapMetadata(m),
-	}
-	_, err = uploader.Upload(ctx, input)
+		Body:     io.MultiReader(bytes.NewReader(header[:n]), mr),
+		Metadata: map[string]string{sidecarMarker: "1"},
+	})
 	if err != nil {
 		return
 	}
 
+	m = mr.Metadata()
+	m.OriginalName = originalName
+	m.Expiry = expiry
+	m.CreatedAt = time.Now()
+	m.DeleteKey = deleteKey
+	m.AccessKey = accessKey
+	m.Encoding = backends.EncodingOf(ctx)
+
+	// listing an archive needs to seek, so it is read back from the bucket
+	object := &objectReader{ctx: ctx, backend: b, key: key, size: m.Size}
+	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, object)
+	object.Close()
+
+	err = b.putSidecar(ctx, key, m, nil)
+	if err != nil {
+		b.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(key),
+		})
+	}
+
 	return
 }
 
+// PutMetadata only replaces the sidecar, so the object is never copied. The
+// sidecar is written conditionally, so a file deleted in the meantime
+// doesn't get it back.
 func (b S3Backend) PutMetadata(ctx context.Context, key string, m backends.Metadata) (err error) {
-	_, err = b.svc.CopyObject(ctx, &s3.CopyObjectInput{
-		Bucket:            aws.String(b.bucket),
-		Key:               aws.String(key),
-		CopySource:        aws.String("/" + b.bucket + "/" + key),
-		Metadata:          mapMetadata(m),
-		MetadataDirective: types.MetadataDirectiveReplace,
+	// a conflict with another update is tried again
+	for attempt := 0; attempt < 3; attempt++ {
+		err = b.replaceSidecar(ctx, key, m)
+		if !isConflict(err) {
+			return
+		}
+	}
+	return
+}
+
+func (b S3Backend) replaceSidecar(ctx context.Context, key string, m backends.Metadata) error {
+	sidecar, err := b.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(metaPrefix + key),
+	})
+	if err == nil {
+		return b.putSidecar(ctx, key, m, func(input *s3.PutObjectInput) {
+			input.IfMatch = sidecar.ETag
+		})
+	} else if !isNotFound(err) {
+		return err
+	}
+
+	// only files from before sidecars get their first one here
+	object, err := b.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return err
+	}
+	if _, ok := object.Metadata[sidecarMarker]; ok {
+		return backends.NotFoundErr
+	}
+
+	err = b.putSidecar(ctx, key, m, func(input *s3.PutObjectInput) {
+		input.IfNoneMatch = aws.String("*")
 	})
 	if err != nil {
-		return
+		return err
 	}
 
-	return
+	// the object may have been deleted before the sidecar was written
+	exists, err := b.Exists(ctx, key)
+	if err == nil && !exists {
+		b.Delete(ctx, key)
+		return backends.NotFoundErr
+	}
+	return err
 }
 
 func (b S3Backend) Size(ctx context.Context, key string) (int64, error) {
@@ -240,27 +407,28 @@ func (b S3Backend) Size(ctx context.Context, key string) (int64, error) {
 }
 
 func (b S3Backend) List(ctx context.Context) ([]string, error) {
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-
 	var output []string
-	input := &s3.ListObjectsInput{
+	paginator := s3.NewListObjectsV2Paginator(b.svc, &s3.ListObjectsV2Input{
 		Bucket: aws.String(b.bucket),
-	}
+	})
 
-	results, err := b.svc.ListObjects(ctx, input)
-	if err != nil {
-		return nil, err
-	}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
 
-	for _, object := range results.Contents {
-		output = append(output, *object.Key)
+		for _, object := range page.Contents {
+			if !strings.HasPrefix(*object.Key, metaPrefix) {
+				output = append(output, *object.Key)
+			}
+		}
 	}
 
 	return output, nil
 }
 
-func NewS3Backend(bucket string, region string, endpoint string, forcePathStyle bool) S3Backend {
+func NewS3Backend(bucket string, region string, endpoint string, forcePathStyle bool, presignExpiry time.Duration) S3Backend {
 	ctx := context.TODO()
 
 	// Load default config
@@ -285,5 +453,86 @@ func NewS3Backend(bucket string, region string, endpoint string, forcePathStyle
 		}
 	})
 
-	return S3Backend{bucket: bucket, svc: svc}
+	return S3Backend{bucket: bucket, svc: svc, presignExpiry: presignExpiry}
+}
+
+// objectReader reads an object with ranged requests. Sequential reads share
+// one request until the next seek.
+type objectReader struct {
+	ctx     context.Context
+	backend S3Backend
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		body, err := o.backend.GetRange(o.ctx, o.key, o.offset, o.size-o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if err == io.EOF && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if offset != o.offset {
+		o.Close()
+		o.offset = offset
+	}
+	return offset, nil
+}
+
+func (o *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), o.size-off)
+	body, err := o.backend.GetRange(o.ctx, o.key, off, length)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p[:length])
+	if err == nil && length < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *objectReader) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
 }
@@ -0,0 +1,637 @@
+package s3
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/cleanup"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+// listPageSize is small so that listing a few files needs several pages
+const listPageSize = 2
+
+type fakeObject struct {
+	data     []byte
+	metadata map[string]string
+	modtime  time.Time
+	etag     string
+}
+
+// fakeS3 implements the parts of the S3 API the backend uses
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]fakeObject
+	parts    map[string]map[int][]byte
+	uploads  map[string]map[string]string
+	versions int
+	// requests counts the requests by method
+	requests map[string]int
+	// beforePut is called with the lock held before an object is written
+	beforePut func(key string)
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, S3Backend) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+
+	f := &fakeS3{
+		objects:  make(map[string]fakeObject),
+		parts:    make(map[string]map[int][]byte),
+		uploads:  make(map[string]map[string]string),
+		requests: make(map[string]int),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	return f, NewS3Backend("bucket", "us-east-1", server.URL, true, 0)
+}
+
+func (f *fakeS3) put(key string, data []byte, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.store(key, data, metadata)
+}
+
+// store writes an object with a new etag, with the lock held
+func (f *fakeS3) store(key string, data []byte, metadata map[string]string) {
+	f.versions++
+	f.objects[key] = fakeObject{data: data, metadata: metadata, modtime: time.Now(), etag: fmt.Sprintf(`"%d"`, f.versions)}
+}
+
+func requestMetadata(r *http.Request) map[string]string {
+	metadata := make(map[string]string)
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			metadata[strings.ToLower(name)[len("x-amz-meta-"):]] = values[0]
+		}
+	}
+	return metadata
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+func (f *fakeS3) get(key string) (fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[key]
+	return object, ok
+}
+
+func (f *fakeS3) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[method]
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.Method]++
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == "GET" && key == "":
+		f.list(w, query.Get("continuation-token"))
+
+	case r.Method == "POST" && query.Has("uploads"):
+		f.parts[key] = make(map[int][]byte)
+		f.uploads[key] = requestMetadata(r)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>", key)
+
+	case r.Method == "PUT" && query.Has("partNumber"):
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := io.ReadAll(r.Body)
+		f.parts[key][n] = data
+		w.Header().Set("ETag", `"part"`)
+
+	case r.Method == "POST" && query.Has("uploadId"):
+		var data []byte
+		for i := 1; i <= len(f.parts[key]); i++ {
+			data = append(data, f.parts[key][i]...)
+		}
+		delete(f.parts, key)
+		if f.beforePut != nil {
+			f.beforePut(key)
+		}
+		f.store(key, data, f.uploads[key])
+		delete(f.uploads, key)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+
+	case r.Method == "DELETE" && query.Has("uploadId"):
+		delete(f.parts, key)
+		delete(f.uploads, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "PUT":
+		data, _ := io.ReadAll(r.Body)
+		if f.beforePut != nil {
+			f.beforePut(key)
+		}
+
+		current, exists := f.objects[key]
+		if match := r.Header.Get("If-Match"); match != "" && !exists {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		} else if match != "" && match != current.etag {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		f.store(key, data, requestMetadata(r))
+		w.Header().Set("ETag", f.objects[key].etag)
+
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "GET" || r.Method == "HEAD":
+		object, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == "GET" {
+				fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			}
+			return
+		}
+
+		for name, value := range object.metadata {
+			w.Header().Set("x-amz-meta-"+name, value)
+		}
+		w.Header().Set("Last-Modified", object.modtime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", object.etag)
+
+		data := object.data
+		status := http.StatusOK
+		if r.Header.Get("Range") != "" {
+			var start, end int
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+			end = min(end, len(data)-1)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, token string) {
+	type content struct{ Key string }
+	type result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+
+	var keys []string
+	for key := range f.objects {
+		if key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var res result
+	if len(keys) > listPageSize {
+		keys = keys[:listPageSize]
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		res.Contents = append(res.Contents, content{key})
+	}
+	res.KeyCount = len(keys)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func TestListAllPages(t *testing.T) {
+	ctx := context.Background()
+	_, b := newFakeS3(t)
+
+	for i := 0; i < 5; i++ {
+		_, err := b.Put(ctx, fmt.Sprintf("file%d.txt", i), "file.txt", strings.NewReader("content"), expiry.NeverExpire, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sidecars are not listed
+	if len(files) != 5 {
+		t.Fatalf("List returned %v", files)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFakeS3(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := b.Put(ctx, fmt.Sprintf("expired%d.txt", i), "expired.txt", strings.NewReader("content"), time.Now().Add(-time.Minute), "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := b.Put(ctx, "kept.txt", "kept.txt", strings.NewReader("content"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup.Cleanup(b, true)
+
+	files, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "kept.txt" {
+		t.Fatalf("Files left after cleanup: %v", files)
+	}
+	if _, ok := f.get(metaPrefix + "expired0.txt"); ok {
+		t.Fatal("Cleanup left the metadata of an expired file")
+	}
+}
+
+func TestPresignedRedirect(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFakeS3(t)
+	b.presignExpiry = time.Minute
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gets := f.count("GET")
+
+	req := httptest.NewRequest("GET", "/a.txt", nil)
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Disposition", `attachment; filename="a.txt"`)
+	w.Header().Set("Content-Length", "7")
+
+	err = b.ServeFile(ctx, "a.txt", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusFound {
+		t.Fatalf("Status code is not 302, but %d", w.Code)
+	}
+	if w.Header().Get("Content-Length") != "" || w.Header().Get("Content-Disposition") != "" {
+		t.Fatal("Headers of the file were sent with the redirect")
+	}
+	if !strings.Contains(w.Header().Get("Cache-Control"), "no-store") {
+		t.Fatal("Redirect to an expiring URL can be cached")
+	}
+	if f.count("GET") != gets {
+		t.Fatal("File was proxied instead of redirected")
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("response-content-type") != "text/plain" || query.Get("response-content-disposition") != `attachment; filename="a.txt"` {
+		t.Fatalf("Presigned URL doesn't set the response headers: %s", location)
+	}
+	if query.Get("X-Amz-Signature") == "" || query.Get("X-Amz-Expires") != "60" {
+		t.Fatalf("URL is not presigned for a minute: %s", location)
+	}
+
+	// the presigned URL serves the file
+	resp, err := http.Get(location.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if string(data) != "content" {
+		t.Fatalf("Presigned URL returned '%s'", data)
+	}
+}
+
+func TestArchiveListingInSidecar(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFakeS3(t)
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("content"))
+	}
+	zw.Close()
+
+	_, err := b.Put(ctx, "a.zip", "a.zip", bytes.NewReader(archive.Bytes()), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.get(metaPrefix + "a.zip"); !ok {
+		t.Fatal("Metadata was not stored in a sidecar")
+	}
+
+	metadata, err := b.Head(ctx, "a.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata.ArchiveFiles, []string{"a.txt", "dir/b.txt"}) || metadata.DeleteKey != "del" {
+		t.Fatalf("Stored metadata is %+v", metadata)
+	}
+
+	// updates only replace the sidecar
+	object, _ := f.get("a.zip")
+	metadata.DeleteKey = "new"
+	err = b.PutMetadata(ctx, "a.zip", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated, _ := f.get("a.zip"); !updated.modtime.Equal(object.modtime) {
+		t.Fatal("Object was rewritten for a metadata update")
+	}
+	if metadata, _ := b.Head(ctx, "a.zip"); metadata.DeleteKey != "new" || len(metadata.ArchiveFiles) != 2 {
+		t.Fatalf("Updated metadata is %+v", metadata)
+	}
+
+	err = b.Delete(ctx, "a.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutMetadata(ctx, "a.zip", metadata)
+	if err != backends.NotFoundErr {
+		t.Fatalf("PutMetadata of a deleted file returned %v", err)
+	}
+	if _, ok := f.get(metaPrefix + "a.zip"); ok {
+		t.Fatal("Sidecar of a deleted file is left")
+	}
+}
+
+func TestObjectMetadataWithoutSidecar(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFakeS3(t)
+
+	// a file stored before sidecars, S3 returns the keys in lower case
+	f.put("old.txt", []byte("content"), map[string]string{
+		"expiry":       "0",
+		"size":         "7",
+		"deletekey":    "del",
+		"originalname": "old.txt",
+		"mimetype":     "text/plain",
+		"sha256sum":    "abc",
+	})
+
+	metadata, err := b.Head(ctx, "old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.DeleteKey != "del" || metadata.Size != 7 || metadata.OriginalName != "old.txt" || metadata.CreatedAt.IsZero() {
+		t.Fatalf("Object metadata was read as %+v", metadata)
+	}
+
+	// the oldest objects named the delete key differently
+	f.put("oldest.txt", []byte("content"), map[string]string{
+		"expiry":       "0",
+		"size":         "7",
+		"delete_key":   "del",
+		"originalname": "oldest.txt",
+	})
+	metadata, err = b.Head(ctx, "oldest.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.DeleteKey != "del" {
+		t.Fatalf("Delete key of the oldest object is '%s'", metadata.DeleteKey)
+	}
+
+	// not stored by linx-server
+	f.put("other.txt", []byte("content"), nil)
+	_, err = b.Head(ctx, "other.txt")
+	if err != backends.BadMetadata {
+		t.Fatalf("Head of an object without metadata returned %v", err)
+	}
+
+	_, err = b.Head(ctx, "missing.txt")
+	if err != backends.NotFoundErr {
+		t.Fatalf("Head of a missing file returned %v", err)
+	}
+}
+
+// failingReader returns an error after its content
+type failingReader struct {
+	io.Reader
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestStreamingPut(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFakeS3(t)
+
+	// larger than a part, so it is uploaded in several
+	content := bytes.Repeat([]byte("0123456789abcdef"), 800000)
+	metadata, err := b.Put(ctx, "big.txt", "big.txt", io.MultiReader(bytes.NewReader(content)), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object, ok := f.get("big.txt")
+	if !ok || !bytes.Equal(object.data, content) {
+		t.Fatal("Stored object differs from the upload")
+	}
+	sum := sha256.Sum256(content)
+	if metadata.Sha256sum != hex.EncodeToString(sum[:]) || metadata.Size != int64(len(content)) || !strings.HasPrefix(metadata.Mimetype, "text/plain") {
+		t.Fatalf("Metadata of the streamed upload is %+v", metadata)
+	}
+	if stored, _ := b.Head(ctx, "big.txt"); stored.Sha256sum != metadata.Sha256sum {
+		t.Fatal("Sidecar doesn't have the final metadata")
+	}
+}
+
+func TestStreamingPutFailure(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFakeS3(t)
+
+	_, err := b.Put(ctx, "empty.txt", "empty.txt", strings.NewReader(""), expiry.NeverExpire, "", "")
+	if err != backends.FileEmptyError {
+		t.Fatalf("Storing an empty file returned %v", err)
+	}
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 800000)
+	_, err = b.Put(ctx, "broken.txt", "broken.txt", failingReader{bytes.NewReader(content)}, expiry.NeverExpire, "", "")
+	if err == nil {
+		t.Fatal("Broken upload was stored")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.objects) != 0 || len(f.parts) != 0 {
+		t.Fatalf("Failed uploads left %d objects and %d multipart uploads", len(f.objects), len(f.parts))
+	}
+}
+
+func serveRequest(t *testing.T, b S3Backend, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/a.txt", nil)
+	req.Header = header
+	w := httptest.NewRecorder()
+	w.Header().Set("Etag", `"abc"`)
+
+	err := b.ServeFile(context.Background(), "a.txt", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestServeRanges(t *testing.T) {
+	ctx := context.Background()
+	_, b := newFakeS3(t)
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("0123456789"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveRequest(t, b, http.Header{"Range": {"bytes=2-4"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Fatalf("Range request returned %d '%s'", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Range") != "bytes 2-4/10" || w.Header().Get("Content-Length") != "3" {
+		t.Fatalf("Range response has Content-Range '%s' and Content-Length '%s'", w.Header().Get("Content-Range"), w.Header().Get("Content-Length"))
+	}
+
+	w = serveRequest(t, b, http.Header{"Range": {"bytes=-3"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "789" {
+		t.Fatalf("Suffix range request returned %d '%s'", w.Code, w.Body.String())
+	}
+
+	w = serveRequest(t, b, http.Header{"Range": {"bytes=0-1,8-9"}})
+	if w.Code != http.StatusPartialContent || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("Multi-range request returned %d with %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "01") || !strings.Contains(w.Body.String(), "89") {
+		t.Fatal("Multi-range response doesn't have both ranges")
+	}
+
+	w = serveRequest(t, b, http.Header{"Range": {"bytes=20-30"}})
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("Unsatisfiable range returned %d", w.Code)
+	}
+
+	// a stale If-Range gets the whole file
+	w = serveRequest(t, b, http.Header{"Range": {"bytes=2-4"}, "If-Range": {`"other"`}})
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("Range with a stale If-Range returned %d '%s'", w.Code, w.Body.String())
+	}
+
+	w = serveRequest(t, b, http.Header{"If-None-Match": {`"abc"`}})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("Matching If-None-Match returned %d", w.Code)
+	}
+}
+
+func TestObjectWithoutItsSidecar(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFakeS3(t)
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as if the sidecar wasn't written yet
+	f.mu.Lock()
+	delete(f.objects, metaPrefix+"a.txt")
+	f.mu.Unlock()
+
+	_, err = b.Head(ctx, "a.txt")
+	if err != backends.NotFoundErr {
+		t.Fatalf("Head of an object without its sidecar returned %v", err)
+	}
+	_, _, err = b.Get(ctx, "a.txt")
+	if err != backends.NotFoundErr {
+		t.Fatalf("Get of an object without its sidecar returned %v", err)
+	}
+	err = b.PutMetadata(ctx, "a.txt", backends.Metadata{DeleteKey: "new"})
+	if err != backends.NotFoundErr {
+		t.Fatalf("PutMetadata of an object without its sidecar returned %v", err)
+	}
+	if _, ok := f.get(metaPrefix + "a.txt"); ok {
+		t.Fatal("Sidecar was written for an incomplete file")
+	}
+}
+
+func TestPutMetadataWhileDeleted(t *testing.T) {
+	ctx := context.Background()
+	f, b := newFakeS3(t)
+
+	m, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is deleted right before the new sidecar is written
+	f.mu.Lock()
+	f.beforePut = func(key string) {
+		delete(f.objects, metaPrefix+"a.txt")
+		delete(f.objects, "a.txt")
+	}
+	f.mu.Unlock()
+
+	m.DeleteKey = "new"
+	err = b.PutMetadata(ctx, "a.txt", m)
+	if err != backends.NotFoundErr {
+		t.Fatalf("PutMetadata of a deleted file returned %v", err)
+	}
+	if _, ok := f.get(metaPrefix + "a.txt"); ok {
+		t.Fatal("Sidecar of a deleted file was written again")
+	}
+}
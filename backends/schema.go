@@ -0,0 +1,138 @@
+package backends
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MetadataVersion is the schema version of newly written metadata. Metadata
+// written before versions were recorded is version 0.
+const MetadataVersion = 1
+
+var MetadataTooNewError = errors.New("metadata was written by a newer version")
+
+// metadataUpgrades holds the steps that upgrade a stored metadata record from
+// the version at their index to the next one. They are applied on read, so
+// old records keep working until they are rewritten. Fields that are simply
+// empty in older records need no step, renamed or reinterpreted fields do.
+var metadataUpgrades = []func(record map[string]any) error{
+	// 0 -> 1: the version is recorded. S3 object metadata from before
+	// sidecars names fields without underscores and holds numbers as
+	// strings, the oldest objects have the delete key as delete_key, which
+	// is used if deletekey is empty.
+	func(record map[string]any) error {
+		for from, to := range map[string]string{"originalname": "original_name", "accesskey": "access_key"} {
+			if value, ok := record[from]; ok {
+				record[to] = value
+				delete(record, from)
+			}
+		}
+
+		if deleteKey, ok := record["deletekey"]; ok {
+			if deleteKey != "" || record["delete_key"] == nil {
+				record["delete_key"] = deleteKey
+			}
+			delete(record, "deletekey")
+		}
+
+		for _, field := range []string{"size", "expiry"} {
+			if value, ok := record[field].(string); ok {
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return fmt.Errorf("%s: %w", field, err)
+				}
+				record[field] = n
+			}
+		}
+		return nil
+	},
+}
+
+// MetadataJSON is how metadata is stored as JSON, in localfs meta files and
+// S3 sidecar objects
+type MetadataJSON struct {
+	Version      int      `json:"version"`
+	OriginalName string   `json:"original_name"`
+	DeleteKey    string   `json:"delete_key"`
+	AccessKey    string   `json:"access_key,omitempty"`
+	Sha256sum    string   `json:"sha256sum"`
+	Mimetype     string   `json:"mimetype"`
+	Size         int64    `json:"size"`
+	Expiry       int64    `json:"expiry"`
+	ArchiveFiles []string `json:"archive_files,omitempty"`
+	Encoding     string   `json:"encoding,omitempty"`
+
+	CreatedAt      int64 `json:"created_at,omitempty"`
+	LastAccessedAt int64 `json:"last_accessed_at,omitempty"`
+}
+
+// EncodeMetadata stores metadata as JSON in the latest version
+func EncodeMetadata(m Metadata) ([]byte, error) {
+	return json.Marshal(MetadataJSON{
+		Version:        MetadataVersion,
+		OriginalName:   m.OriginalName,
+		DeleteKey:      m.DeleteKey,
+		AccessKey:      m.AccessKey,
+		Sha256sum:      m.Sha256sum,
+		Mimetype:       m.Mimetype,
+		Size:           m.Size,
+		Expiry:         m.Expiry.Unix(),
+		ArchiveFiles:   m.ArchiveFiles,
+		Encoding:       m.Encoding,
+		CreatedAt:      UnixTimestamp(m.CreatedAt),
+		LastAccessedAt: UnixTimestamp(m.LastAccessedAt),
+	})
+}
+
+// DecodeMetadata reads metadata stored as JSON, upgrading it first if it was
+// written in an older version
+func DecodeMetadata(data []byte) (m Metadata, err error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return m, BadMetadata
+	}
+	if header.Version > MetadataVersion {
+		return m, fmt.Errorf("%w: version %d", MetadataTooNewError, header.Version)
+	}
+
+	if header.Version < MetadataVersion {
+		var record map[string]any
+		if err := json.Unmarshal(data, &record); err != nil {
+			return m, BadMetadata
+		}
+		for version := header.Version; version < MetadataVersion; version++ {
+			err := metadataUpgrades[version](record)
+			if err != nil {
+				return m, fmt.Errorf("upgrading metadata from version %d: %w", version, err)
+			}
+		}
+		data, err = json.Marshal(record)
+		if err != nil {
+			return m, err
+		}
+	}
+
+	mjson := MetadataJSON{}
+	if err := json.Unmarshal(data, &mjson); err != nil {
+		return m, BadMetadata
+	}
+
+	m.OriginalName = mjson.OriginalName
+	m.DeleteKey = mjson.DeleteKey
+	m.AccessKey = mjson.AccessKey
+	m.Sha256sum = mjson.Sha256sum
+	m.Mimetype = mjson.Mimetype
+	m.Size = mjson.Size
+	m.Expiry = time.Unix(mjson.Expiry, 0)
+	m.ArchiveFiles = mjson.ArchiveFiles
+	m.Encoding = mjson.Encoding
+	m.CreatedAt = UnixTime(mjson.CreatedAt)
+	m.LastAccessedAt = UnixTime(mjson.LastAccessedAt)
+
+	return m, nil
+}
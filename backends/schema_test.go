@@ -0,0 +1,125 @@
+package backends_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func TestEncodeMetadata(t *testing.T) {
+	m := backends.Metadata{
+		OriginalName: "a.txt",
+		DeleteKey:    "del",
+		Size:         7,
+		Expiry:       time.Unix(2000000000, 0),
+		CreatedAt:    time.Unix(1700000000, 0),
+	}
+
+	data, err := backends.EncodeMetadata(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), fmt.Sprintf(`"version":%d`, backends.MetadataVersion)) {
+		t.Fatalf("Encoded metadata has no version: %s", data)
+	}
+
+	decoded, err := backends.DecodeMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.OriginalName != "a.txt" || decoded.DeleteKey != "del" || !decoded.Expiry.Equal(m.Expiry) || !decoded.CreatedAt.Equal(m.CreatedAt) {
+		t.Fatalf("Decoded metadata is %+v", decoded)
+	}
+}
+
+func TestMetadataTooNew(t *testing.T) {
+	data := fmt.Sprintf(`{"version":%d,"original_name":"a.txt","expiry":0}`, backends.MetadataVersion+1)
+
+	_, err := backends.DecodeMetadata([]byte(data))
+	if !errors.Is(err, backends.MetadataTooNewError) {
+		t.Fatalf("Decoding metadata of a newer version returned %v", err)
+	}
+
+	_, err = backends.DecodeMetadata([]byte("not json"))
+	if err != backends.BadMetadata {
+		t.Fatalf("Decoding broken metadata returned %v", err)
+	}
+}
+
+func TestUpgradeMetadata(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		data      string
+		deleteKey string
+	}{
+		{"localfs", `{"original_name":"a.txt","delete_key":"del","size":7,"expiry":0}`, "del"},
+		{"S3 object", `{"originalname":"a.txt","deletekey":"del","size":"7","expiry":"0"}`, "del"},
+		{"oldest S3 object", `{"originalname":"a.txt","deletekey":"","delete_key":"del","size":"7","expiry":"0"}`, "del"},
+		{"S3 object with both keys", `{"originalname":"a.txt","deletekey":"new","delete_key":"old","size":"7","expiry":"0"}`, "new"},
+	} {
+		m, err := backends.DecodeMetadata([]byte(test.data))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if m.OriginalName != "a.txt" || m.DeleteKey != test.deleteKey || m.Size != 7 || m.Expiry != expiry.NeverExpire {
+			t.Fatalf("%s: upgraded metadata is %+v", test.name, m)
+		}
+	}
+
+	_, err := backends.DecodeMetadata([]byte(`{"originalname":"a.txt","size":"seven","expiry":"0"}`))
+	if err == nil {
+		t.Fatal("Metadata with a broken size was upgraded")
+	}
+}
+
+func TestUpgradeMetadataFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, sub := range []string{"meta", "files"} {
+		err := os.Mkdir(path.Join(dir, sub), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := localfs.NewLocalfsBackend(path.Join(dir, "meta"), path.Join(dir, "files"), 0, false, false)
+
+	// a file stored before versions were recorded
+	err := os.WriteFile(path.Join(dir, "files", "a.txt"), []byte("content"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dir, "meta", "a.txt"), []byte(`{"original_name":"a.txt","delete_key":"del","size":7,"expiry":0}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what linx-upgrade-metadata does
+	metadata, err := b.Head(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutMetadata(ctx, "a.txt", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path.Join(dir, "meta", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), fmt.Sprintf(`"version":%d`, backends.MetadataVersion)) {
+		t.Fatalf("Metadata was not rewritten in the latest version: %s", data)
+	}
+	if metadata, _ := b.Head(ctx, "a.txt"); metadata.DeleteKey != "del" {
+		t.Fatal("Upgrade lost the delete key")
+	}
+}
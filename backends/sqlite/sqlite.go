@@ -0,0 +1,223 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS files (
+	key           TEXT PRIMARY KEY,
+	original_name TEXT NOT NULL,
+	delete_key    TEXT NOT NULL,
+	access_key    TEXT NOT NULL,
+	sha256sum     TEXT NOT NULL,
+	mimetype      TEXT NOT NULL,
+	size          INTEGER NOT NULL,
+	expiry        INTEGER NOT NULL,
+	archive_files TEXT NOT NULL,
+	encoding      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_expiry ON files (expiry);
+CREATE INDEX IF NOT EXISTS files_sha256sum ON files (sha256sum);
+CREATE INDEX IF NOT EXISTS files_mimetype ON files (mimetype);
+CREATE INDEX IF NOT EXISTS files_size ON files (size);
+`
+
+// migrations bring databases created by older versions up to date, the
+// user_version of a database is the number of migrations applied to it
+var migrations = []string{
+	`ALTER TABLE files ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE files ADD COLUMN last_accessed_at INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// SqliteMetaStore keeps file metadata in a single SQLite database
+type SqliteMetaStore struct {
+	db *sql.DB
+}
+
+func (s SqliteMetaStore) Get(ctx context.Context, key string) (m backends.Metadata, err error) {
+	var expiryTs, createdTs, accessedTs int64
+	var archiveFiles string
+	err = s.db.QueryRowContext(ctx, `SELECT original_name, delete_key, access_key, sha256sum,
+		mimetype, size, expiry, archive_files, encoding, created_at, last_accessed_at
+		FROM files WHERE key = ?`, key).Scan(
+		&m.OriginalName, &m.DeleteKey, &m.AccessKey, &m.Sha256sum,
+		&m.Mimetype, &m.Size, &expiryTs, &archiveFiles, &m.Encoding, &createdTs, &accessedTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, backends.NotFoundErr
+	} else if err != nil {
+		return m, err
+	}
+
+	m.Expiry = time.Unix(expiryTs, 0)
+	m.CreatedAt = backends.UnixTime(createdTs)
+	m.LastAccessedAt = backends.UnixTime(accessedTs)
+	if archiveFiles != "" {
+		if err := json.Unmarshal([]byte(archiveFiles), &m.ArchiveFiles); err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	return m, nil
+}
+
+func (s SqliteMetaStore) Put(ctx context.Context, key string, m backends.Metadata) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO files (key, original_name, delete_key,
+		access_key, sha256sum, mimetype, size, expiry, archive_files, encoding, created_at,
+		last_accessed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		append([]any{key}, columns(m)...)...)
+	return err
+}
+
+func (s SqliteMetaStore) Update(ctx context.Context, key string, m backends.Metadata) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE files SET original_name = ?, delete_key = ?,
+		access_key = ?, sha256sum = ?, mimetype = ?, size = ?, expiry = ?, archive_files = ?,
+		encoding = ?, created_at = ?, last_accessed_at = ? WHERE key = ?`,
+		append(columns(m), key)...)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if rows == 0 {
+		return backends.NotFoundErr
+	}
+	return nil
+}
+
+func (s SqliteMetaStore) MarkAccessed(ctx context.Context, key string, t time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE files SET last_accessed_at = ? WHERE key = ? AND last_accessed_at < ?",
+		t.Unix(), key, t.Unix())
+	return err
+}
+
+// columns lists the metadata in the order of the table columns after key
+func columns(m backends.Metadata) []any {
+	var archiveFiles []byte
+	if len(m.ArchiveFiles) > 0 {
+		archiveFiles, _ = json.Marshal(m.ArchiveFiles)
+	}
+
+	return []any{m.OriginalName, m.DeleteKey, m.AccessKey, m.Sha256sum,
+		m.Mimetype, m.Size, m.Expiry.Unix(), string(archiveFiles), m.Encoding,
+		backends.UnixTimestamp(m.CreatedAt), backends.UnixTimestamp(m.LastAccessedAt)}
+}
+
+func (s SqliteMetaStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM files WHERE key = ?", key)
+	return err
+}
+
+func (s SqliteMetaStore) List(ctx context.Context) ([]string, error) {
+	return s.Find(ctx, backends.MetaQuery{})
+}
+
+func (s SqliteMetaStore) Find(ctx context.Context, q backends.MetaQuery) ([]string, error) {
+	var where []string
+	var args []any
+	if !q.ExpiredBefore.IsZero() {
+		where = append(where, "expiry != ? AND expiry < ?")
+		args = append(args, expiry.NeverExpire.Unix(), q.ExpiredBefore.Unix())
+	}
+	if q.MinSize > 0 {
+		where = append(where, "size >= ?")
+		args = append(args, q.MinSize)
+	}
+	if q.MaxSize > 0 {
+		where = append(where, "size <= ?")
+		args = append(args, q.MaxSize)
+	}
+	if q.Mimetype != "" {
+		where = append(where, "mimetype = ?")
+		args = append(args, q.Mimetype)
+	}
+	if q.Sha256sum != "" {
+		where = append(where, "sha256sum = ?")
+		args = append(args, q.Sha256sum)
+	}
+
+	query := "SELECT key FROM files"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var output []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		output = append(output, key)
+	}
+
+	return output, rows.Err()
+}
+
+func (s SqliteMetaStore) Close() error {
+	return s.db.Close()
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migrations[version])
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewSqliteMetaStore(path string) (SqliteMetaStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return SqliteMetaStore{}, err
+	}
+
+	_, err = db.Exec(schema)
+	if err == nil {
+		err = migrate(db)
+	}
+	if err != nil {
+		db.Close()
+		return SqliteMetaStore{}, err
+	}
+
+	return SqliteMetaStore{db: db}, nil
+}
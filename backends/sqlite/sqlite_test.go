@@ -0,0 +1,223 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func newTestStore(t *testing.T) SqliteMetaStore {
+	s, err := NewSqliteMetaStore(path.Join(t.TempDir(), "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	m := backends.Metadata{
+		OriginalName: "a.zip",
+		DeleteKey:    "del",
+		AccessKey:    "acc",
+		Sha256sum:    "abc",
+		Mimetype:     "application/zip",
+		Size:         42,
+		Expiry:       time.Unix(2000000000, 0),
+		ArchiveFiles: []string{"a.txt", "dir/b.txt"},
+		Encoding:     "gzip",
+		CreatedAt:    time.Unix(1700000000, 0),
+	}
+	err := s.Put(ctx, "a.zip", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := s.Get(ctx, "a.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored, m) {
+		t.Fatalf("Stored metadata %+v differs from %+v", stored, m)
+	}
+
+	_, err = s.Get(ctx, "missing")
+	if err != backends.NotFoundErr {
+		t.Fatalf("Getting a missing file returned %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	m := backends.Metadata{Size: 1, Expiry: expiry.NeverExpire}
+	err := s.Put(ctx, "a.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.DeleteKey = "new"
+	err = s.Update(ctx, "a.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := s.Get(ctx, "a.txt"); stored.DeleteKey != "new" {
+		t.Fatal("Update did not change the metadata")
+	}
+
+	err = s.Delete(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Update(ctx, "a.txt", m)
+	if err != backends.NotFoundErr {
+		t.Fatalf("Updating a deleted file returned %v", err)
+	}
+	if _, err := s.Get(ctx, "a.txt"); err != backends.NotFoundErr {
+		t.Fatal("Update brought back a deleted file")
+	}
+}
+
+func TestFind(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	files := map[string]backends.Metadata{
+		"expired.txt": {Mimetype: "text/plain", Size: 10, Expiry: time.Now().Add(-time.Minute), Sha256sum: "a"},
+		"later.png":   {Mimetype: "image/png", Size: 1000, Expiry: time.Now().Add(time.Hour), Sha256sum: "b"},
+		"never.png":   {Mimetype: "image/png", Size: 100, Expiry: expiry.NeverExpire, Sha256sum: "a"},
+	}
+	for key, m := range files {
+		err := s.Put(ctx, key, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		query    backends.MetaQuery
+		expected []string
+	}{
+		{backends.MetaQuery{}, []string{"expired.txt", "later.png", "never.png"}},
+		{backends.MetaQuery{ExpiredBefore: time.Now()}, []string{"expired.txt"}},
+		{backends.MetaQuery{MinSize: 100}, []string{"later.png", "never.png"}},
+		{backends.MetaQuery{MaxSize: 100}, []string{"expired.txt", "never.png"}},
+		{backends.MetaQuery{Mimetype: "image/png", MaxSize: 500}, []string{"never.png"}},
+		{backends.MetaQuery{Sha256sum: "a"}, []string{"expired.txt", "never.png"}},
+	} {
+		found, err := s.Find(ctx, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(found)
+		if !reflect.DeepEqual(found, test.expected) {
+			t.Fatalf("Query %+v found %v instead of %v", test.query, found, test.expected)
+		}
+	}
+}
+
+func TestMigrateOldDatabase(t *testing.T) {
+	ctx := context.Background()
+	dbPath := path.Join(t.TempDir(), "meta.db")
+
+	// the table as created before the timestamp columns were added
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE files (key TEXT PRIMARY KEY, original_name TEXT NOT NULL,
+		delete_key TEXT NOT NULL, access_key TEXT NOT NULL, sha256sum TEXT NOT NULL,
+		mimetype TEXT NOT NULL, size INTEGER NOT NULL, expiry INTEGER NOT NULL,
+		archive_files TEXT NOT NULL, encoding TEXT NOT NULL);
+		INSERT INTO files VALUES ('a.txt', 'a.txt', 'del', '', 'abc', 'text/plain', 7, 0, '', '');`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSqliteMetaStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	m, err := s.Get(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.DeleteKey != "del" || !m.CreatedAt.IsZero() {
+		t.Fatalf("Migrated metadata is %+v", m)
+	}
+
+	var version int
+	s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if version != len(migrations) {
+		t.Fatalf("Database is at version %d instead of %d", version, len(migrations))
+	}
+}
+
+func TestMarkAccessed(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	m := backends.Metadata{DeleteKey: "del", Expiry: expiry.NeverExpire}
+	err := s.Put(ctx, "a.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changed after the download read the metadata
+	m.DeleteKey = "new"
+	err = s.Update(ctx, "a.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accessed := time.Unix(1700000000, 0)
+	for _, at := range []time.Time{accessed, accessed.Add(-time.Hour)} {
+		err = s.MarkAccessed(ctx, "a.txt", at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored, _ := s.Get(ctx, "a.txt")
+	if !stored.LastAccessedAt.Equal(accessed) || stored.DeleteKey != "new" {
+		t.Fatalf("Metadata after recording the access is %+v", stored)
+	}
+
+	err = s.MarkAccessed(ctx, "missing.txt", accessed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "missing.txt"); err != backends.NotFoundErr {
+		t.Fatal("Recording an access created metadata")
+	}
+}
+
+func TestPragmas(t *testing.T) {
+	s := newTestStore(t)
+
+	var mode string
+	var timeout int
+	err := s.db.QueryRow("PRAGMA journal_mode").Scan(&mode)
+	if err == nil {
+		err = s.db.QueryRow("PRAGMA busy_timeout").Scan(&timeout)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" || timeout != 5000 {
+		t.Fatalf("Database opened with journal mode '%s' and busy timeout %d", mode, timeout)
+	}
+}
@@ -5,7 +5,10 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/andreimarcu/linx-server/expiry"
 )
 
 type StorageBackend interface {
@@ -24,5 +27,139 @@ type MetaStorageBackend interface {
 	List(ctx context.Context) ([]string, error)
 }
 
+// RangeStorageBackend is implemented by backends that can read a part of a
+// stored file without fetching all of it.
+type RangeStorageBackend interface {
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// GetRange reads length bytes of the stored file starting at offset. Backends
+// without ranged reads fall back to skipping over the start of the file.
+func GetRange(ctx context.Context, b StorageBackend, key string, offset, length int64) (io.ReadCloser, error) {
+	if rb, ok := b.(RangeStorageBackend); ok {
+		return rb.GetRange(ctx, key, offset, length)
+	}
+
+	_, r, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.CopyN(io.Discard, r, offset)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return limitedReadCloser{io.LimitReader(r, length), r}, nil
+}
+
+// ExpiryStorageBackend is implemented by backends that can find expired files
+// without reading the metadata of every file.
+type ExpiryStorageBackend interface {
+	ListExpired(ctx context.Context, before time.Time) ([]string, error)
+}
+
+// ListExpired returns the files that expired before the given time. Backends
+// that can't look them up directly have the metadata of every file checked.
+func ListExpired(ctx context.Context, b MetaStorageBackend, before time.Time) ([]string, error) {
+	if eb, ok := b.(ExpiryStorageBackend); ok {
+		return eb.ListExpired(ctx, before)
+	}
+
+	files, err := b.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var output []string
+	for _, key := range files {
+		metadata, err := b.Head(ctx, key)
+		if err != nil {
+			continue
+		}
+		if metadata.Expiry != expiry.NeverExpire && metadata.Expiry.Before(before) {
+			output = append(output, key)
+		}
+	}
+
+	return output, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// AccessTimeStorageBackend is implemented by backends that can record when a
+// file was last downloaded without rewriting the rest of its metadata.
+type AccessTimeStorageBackend interface {
+	MarkAccessed(ctx context.Context, key string, t time.Time) error
+}
+
+// MarkAccessed records t as the last access of key unless a later one is
+// already recorded. Backends without their own way of doing so have the
+// current metadata read and written back.
+func MarkAccessed(ctx context.Context, b StorageBackend, key string, t time.Time) error {
+	if ab, ok := b.(AccessTimeStorageBackend); ok {
+		return ab.MarkAccessed(ctx, key, t)
+	}
+
+	metadata, err := b.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !metadata.LastAccessedAt.Before(t) {
+		return nil
+	}
+
+	metadata.LastAccessedAt = t
+	return b.PutMetadata(ctx, key, metadata)
+}
+
+// ServeModTime returns the time of the Last-Modified header the caller set
+// from the metadata of a file, or fallback without one. Files are served
+// with it since the time a file was written to storage, e.g. that of a
+// deduplicated blob, may differ from its upload.
+func ServeModTime(w http.ResponseWriter, fallback time.Time) time.Time {
+	if modtime, err := http.ParseTime(w.Header().Get("Last-Modified")); err == nil {
+		return modtime
+	}
+	return fallback
+}
+
+// ReservingStorageBackend is implemented by backends that can claim the name
+// of a new upload before it is stored.
+type ReservingStorageBackend interface {
+	Reserve(ctx context.Context, key string) error
+}
+
+// Reserve claims key for a new upload and returns FileExistsErr if it is
+// already in use. Backends without reservations only have the key checked.
+func Reserve(ctx context.Context, b StorageBackend, key string) error {
+	if rb, ok := b.(ReservingStorageBackend); ok {
+		return rb.Reserve(ctx, key)
+	}
+
+	exists, err := b.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return FileExistsErr
+	}
+	return nil
+}
+
+// StagingPrefix starts the keys of the parts of unfinished resumable
+// uploads. Only the upload they belong to uses them, so files with it are
+// left out when files are moved or copied elsewhere.
+const StagingPrefix = "staging-"
+
+func IsStaging(key string) bool {
+	return strings.HasPrefix(key, StagingPrefix)
+}
+
 var NotFoundErr = errors.New("File not found.")
+var FileExistsErr = errors.New("File already exists.")
 var FileEmptyError = errors.New("Empty file")
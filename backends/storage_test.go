@@ -0,0 +1,72 @@
+package backends_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func TestMarkAccessed(t *testing.T) {
+	ctx := context.Background()
+	b := memory.NewMemoryBackend(0)
+
+	metadata, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changed after the download read the metadata
+	metadata.DeleteKey = "new"
+	err = b.PutMetadata(ctx, "a.txt", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accessed := time.Now()
+	err = backends.MarkAccessed(ctx, b, "a.txt", accessed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backends.MarkAccessed(ctx, b, "a.txt", accessed.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, _ = b.Head(ctx, "a.txt")
+	if !metadata.LastAccessedAt.Equal(accessed) {
+		t.Fatalf("Last access is %s instead of %s", metadata.LastAccessedAt, accessed)
+	}
+	if metadata.DeleteKey != "new" {
+		t.Fatal("Recording the access undid a metadata change")
+	}
+
+	err = b.Delete(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backends.MarkAccessed(ctx, b, "a.txt", accessed)
+	if err != backends.NotFoundErr {
+		t.Fatalf("Marking a deleted file returned %v", err)
+	}
+}
+
+func TestServeModTime(t *testing.T) {
+	fallback := time.Unix(1000, 0)
+
+	w := httptest.NewRecorder()
+	if modtime := backends.ServeModTime(w, fallback); !modtime.Equal(fallback) {
+		t.Fatalf("Modtime without a header is %s", modtime)
+	}
+
+	created := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.Header().Set("Last-Modified", created.Format(http.TimeFormat))
+	if modtime := backends.ServeModTime(w, fallback); !modtime.Equal(created) {
+		t.Fatalf("Modtime is %s instead of the Last-Modified header", modtime)
+	}
+}
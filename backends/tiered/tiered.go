@@ -0,0 +1,314 @@
+package tiered
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+// TieredBackend keeps new uploads on local disk and moves them to a cold
+// backend (usually S3) once they are old enough or the disk runs full.
+type TieredBackend struct {
+	hot          localfs.LocalfsBackend
+	cold         backends.MetaStorageBackend
+	migrateAfter time.Duration
+	locks        *keyLocks
+}
+
+// keyLocks keeps a file from being deleted or changed while its migration
+// completes. The locks are striped so they don't grow with the files.
+type keyLocks [64]sync.Mutex
+
+func (l *keyLocks) lock(key string) (unlock func()) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &l[h.Sum32()%uint32(len(l))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// tier returns the backend currently holding the file
+func (b TieredBackend) tier(ctx context.Context, key string) (backends.StorageBackend, error) {
+	exists, err := b.hot.Exists(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return b.hot, nil
+	}
+
+	return b.cold, nil
+}
+
+func (b TieredBackend) Delete(ctx context.Context, key string) error {
+	unlock := b.locks.lock(key)
+	defer unlock()
+
+	tier, err := b.tier(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return tier.Delete(ctx, key)
+}
+
+func (b TieredBackend) Exists(ctx context.Context, key string) (bool, error) {
+	exists, err := b.hot.Exists(ctx, key)
+	if err != nil || exists {
+		return exists, err
+	}
+
+	return b.cold.Exists(ctx, key)
+}
+
+func (b TieredBackend) Reserve(ctx context.Context, key string) error {
+	exists, err := b.cold.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return backends.FileExistsErr
+	}
+
+	return b.hot.Reserve(ctx, key)
+}
+
+func (b TieredBackend) Head(ctx context.Context, key string) (backends.Metadata, error) {
+	metadata, err := b.hot.Head(ctx, key)
+	if err == backends.NotFoundErr {
+		return b.cold.Head(ctx, key)
+	}
+
+	return metadata, err
+}
+
+func (b TieredBackend) Get(ctx context.Context, key string) (backends.Metadata, io.ReadCloser, error) {
+	tier, err := b.tier(ctx, key)
+	if err != nil {
+		return backends.Metadata{}, nil, err
+	}
+
+	return tier.Get(ctx, key)
+}
+
+func (b TieredBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	tier, err := b.tier(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return backends.GetRange(ctx, tier, key, offset, length)
+}
+
+func (b TieredBackend) ServeFile(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) error {
+	tier, err := b.tier(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return tier.ServeFile(ctx, key, w, r)
+}
+
+func (b TieredBackend) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (backends.Metadata, error) {
+	counter := &countingReader{r: r}
+
+	m, err := b.hot.Put(ctx, key, originalName, counter, expiry, deleteKey, accessKey)
+	if errors.Is(err, localfs.InsufficientSpaceError) && counter.n == 0 {
+		// the local disk refused the upload before reading any of it
+		return b.cold.Put(ctx, key, originalName, r, expiry, deleteKey, accessKey)
+	}
+
+	return m, err
+}
+
+func (b TieredBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	unlock := b.locks.lock(key)
+	defer unlock()
+
+	tier, err := b.tier(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return tier.PutMetadata(ctx, key, m)
+}
+
+func (b TieredBackend) Size(ctx context.Context, key string) (int64, error) {
+	tier, err := b.tier(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return tier.Size(ctx, key)
+}
+
+func (b TieredBackend) List(ctx context.Context) ([]string, error) {
+	hotFiles, err := b.hot.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coldFiles, err := b.cold.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var output []string
+	for _, name := range append(hotFiles, coldFiles...) {
+		if !seen[name] {
+			seen[name] = true
+			output = append(output, name)
+		}
+	}
+
+	return output, nil
+}
+
+// Migrate moves files that weren't uploaded or downloaded within
+// migrateAfter to the cold backend, then keeps moving the least recently
+// used remaining files while the local disk is low on space.
+func (b TieredBackend) Migrate(ctx context.Context, noLogs bool) error {
+	files, err := b.hot.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	type hotFile struct {
+		key      string
+		lastUsed time.Time
+	}
+	var candidates []hotFile
+	for _, key := range files {
+		// staged parts of unfinished uploads are only kept for a while
+		if backends.IsStaging(key) {
+			continue
+		}
+		lastUsed, err := b.lastUsed(ctx, key)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, hotFile{key, lastUsed})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+
+	for _, file := range candidates {
+		old := b.migrateAfter > 0 && time.Since(file.lastUsed) > b.migrateAfter
+		if !old {
+			low, err := b.hot.LowOnSpace()
+			if err != nil {
+				return err
+			}
+			if !low {
+				continue
+			}
+		}
+
+		err := b.migrateFile(ctx, file.key)
+		if err != nil {
+			if !noLogs {
+				log.Printf("Failed to migrate %s: %v", file.key, err)
+			}
+			continue
+		}
+		if !noLogs {
+			log.Printf("Migrated %s to cold storage", file.key)
+		}
+	}
+
+	return nil
+}
+
+// lastUsed is when a hot file was uploaded or last downloaded, files stored
+// without timestamps go by the time they were written
+func (b TieredBackend) lastUsed(ctx context.Context, key string) (time.Time, error) {
+	metadata, err := b.hot.Head(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	lastUsed := metadata.CreatedAt
+	if metadata.LastAccessedAt.After(lastUsed) {
+		lastUsed = metadata.LastAccessedAt
+	}
+	if lastUsed.IsZero() {
+		return b.hot.ModTime(ctx, key)
+	}
+	return lastUsed, nil
+}
+
+func (b TieredBackend) migrateFile(ctx context.Context, key string) error {
+	metadata, err := b.hot.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	// expired files are left for the cleanup to remove
+	if expiry.IsTsExpired(metadata.Expiry) {
+		return nil
+	}
+
+	err = backends.Copy(ctx, key, b.hot, b.cold)
+	if err != nil {
+		return err
+	}
+
+	// the file may have been deleted or changed while it was copied
+	unlock := b.locks.lock(key)
+	defer unlock()
+
+	metadata, err = b.hot.Head(ctx, key)
+	if err == backends.NotFoundErr {
+		return b.cold.Delete(ctx, key)
+	} else if err != nil {
+		return err
+	}
+	err = b.cold.PutMetadata(ctx, key, metadata)
+	if err != nil {
+		return err
+	}
+
+	return b.hot.Delete(ctx, key)
+}
+
+func (b TieredBackend) PeriodicMigrate(interval time.Duration, noLogs bool) {
+	c := time.Tick(interval)
+	for range c {
+		err := b.Migrate(context.Background(), noLogs)
+		if err != nil && !noLogs {
+			log.Printf("Migration to cold storage failed: %v", err)
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func NewTieredBackend(hot localfs.LocalfsBackend, cold backends.MetaStorageBackend, migrateAfter time.Duration) TieredBackend {
+	return TieredBackend{
+		hot:          hot,
+		cold:         cold,
+		migrateAfter: migrateAfter,
+		locks:        &keyLocks{},
+	}
+}
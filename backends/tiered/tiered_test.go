@@ -0,0 +1,232 @@
+package tiered
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func newHot(t *testing.T, minFreeSpaceGB float64) localfs.LocalfsBackend {
+	dir := t.TempDir()
+	for _, sub := range []string{"meta", "files"} {
+		err := os.Mkdir(path.Join(dir, sub), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return localfs.NewLocalfsBackend(path.Join(dir, "meta"), path.Join(dir, "files"), minFreeSpaceGB, false, false)
+}
+
+func read(t *testing.T, b backends.StorageBackend, key string) (backends.Metadata, string) {
+	metadata, r, err := b.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata, string(data)
+}
+
+func TestPutStaysHot(t *testing.T) {
+	ctx := context.Background()
+	hot := newHot(t, 0)
+	cold := memory.NewMemoryBackend(0)
+	b := NewTieredBackend(hot, cold, time.Hour)
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := hot.Exists(ctx, "a.txt"); !exists {
+		t.Fatal("New upload was not stored on the hot tier")
+	}
+	if exists, _ := cold.Exists(ctx, "a.txt"); exists {
+		t.Fatal("New upload was stored on the cold tier")
+	}
+
+	err = b.Migrate(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := hot.Exists(ctx, "a.txt"); !exists {
+		t.Fatal("Recent upload was migrated")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	hot := newHot(t, 0)
+	cold := memory.NewMemoryBackend(0)
+	b := NewTieredBackend(hot, cold, time.Nanosecond)
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "del", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put(ctx, "expired.txt", "expired.txt", strings.NewReader("content"), time.Now().Add(-time.Minute), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put(ctx, "staging-a.txt", "", strings.NewReader("content"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Migrate(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := hot.Exists(ctx, "a.txt"); exists {
+		t.Fatal("Old file is still on the hot tier")
+	}
+	metadata, content := read(t, b, "a.txt")
+	if content != "content" {
+		t.Fatalf("Migrated file has content '%s'", content)
+	}
+	if metadata.DeleteKey != "del" || metadata.OriginalName != "a.txt" {
+		t.Fatal("Metadata was not kept during migration")
+	}
+
+	if exists, _ := cold.Exists(ctx, "expired.txt"); exists {
+		t.Fatal("Expired file was migrated")
+	}
+	if exists, _ := cold.Exists(ctx, "staging-a.txt"); exists {
+		t.Fatal("Staged file was migrated")
+	}
+
+	files, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("List returned %v", files)
+	}
+
+	// names on the cold tier stay taken
+	err = b.Reserve(ctx, "a.txt")
+	if err != backends.FileExistsErr {
+		t.Fatalf("Reserving a migrated name returned %v", err)
+	}
+}
+
+func TestPutFallsBackToCold(t *testing.T) {
+	ctx := context.Background()
+	// no disk has this much space left
+	hot := newHot(t, 1e12)
+	cold := memory.NewMemoryBackend(0)
+	b := NewTieredBackend(hot, cold, 0)
+
+	_, err := b.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := cold.Exists(ctx, "a.txt"); !exists {
+		t.Fatal("Upload refused by the hot tier was not stored on the cold tier")
+	}
+	if _, content := read(t, b, "a.txt"); content != "content" {
+		t.Fatalf("File has content '%s'", content)
+	}
+}
+
+func TestMigrateByLastUse(t *testing.T) {
+	ctx := context.Background()
+	hot := newHot(t, 0)
+	cold := memory.NewMemoryBackend(0)
+	b := NewTieredBackend(hot, cold, time.Hour)
+
+	for key, lastAccess := range map[string]time.Time{
+		"unused.txt":     {},
+		"downloaded.txt": time.Now(),
+	} {
+		m, err := b.Put(ctx, key, key, strings.NewReader("content"), expiry.NeverExpire, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.CreatedAt = time.Now().Add(-2 * time.Hour)
+		m.LastAccessedAt = lastAccess
+		err = b.PutMetadata(ctx, key, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := b.Migrate(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := cold.Exists(ctx, "unused.txt"); !exists {
+		t.Fatal("File uploaded long ago was not migrated")
+	}
+	if exists, _ := hot.Exists(ctx, "downloaded.txt"); !exists {
+		t.Fatal("Recently downloaded file was migrated")
+	}
+}
+
+// hookedCold runs a function after each file it stores
+type hookedCold struct {
+	memory.MemoryBackend
+	afterPut func(key string)
+}
+
+func (h hookedCold) Put(ctx context.Context, key, originalName string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (backends.Metadata, error) {
+	m, err := h.MemoryBackend.Put(ctx, key, originalName, r, expiry, deleteKey, accessKey)
+	h.afterPut(key)
+	return m, err
+}
+
+func TestMigrateWhileChanged(t *testing.T) {
+	ctx := context.Background()
+	hot := newHot(t, 0)
+	cold := memory.NewMemoryBackend(0)
+	var b TieredBackend
+	var afterPut func(key string)
+	b = NewTieredBackend(hot, hookedCold{cold, func(key string) { afterPut(key) }}, time.Nanosecond)
+
+	for _, key := range []string{"deleted.txt", "changed.txt"} {
+		_, err := b.Put(ctx, key, key, strings.NewReader("content"), expiry.NeverExpire, "del", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	afterPut = func(key string) {
+		if key == "deleted.txt" {
+			b.Delete(ctx, key)
+		} else if m, err := hot.Head(ctx, key); err == nil {
+			m.DeleteKey = "new"
+			b.PutMetadata(ctx, key, m)
+		}
+	}
+	err := b.Migrate(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := b.Exists(ctx, "deleted.txt"); exists {
+		t.Fatal("File deleted during its migration came back")
+	}
+	metadata, err := b.Head(ctx, "changed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.DeleteKey != "new" {
+		t.Fatal("Metadata changed during the migration was lost")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/labstack/echo/v4"
+)
+
+// uploadChunkHandler receives one chunk of a file that the web uploader
+// splits up to stay below the request size limit of a proxy. Chunks carry
+// the fields of Dropzone's chunking and are staged until the last one
+// arrives, which is answered like a regular upload. They have to be sent
+// one after another, in order. The last chunk may carry the sha256sum of the
+// whole file, the upload is rejected if the stored file doesn't match it.
+func uploadChunkHandler(c echo.Context, upReq UploadRequest, fields url.Values) error {
+	ctx := upReq.ctx
+
+	index, err1 := strconv.Atoi(fields.Get("dzchunkindex"))
+	count, err2 := strconv.Atoi(fields.Get("dztotalchunkcount"))
+	size, err3 := strconv.ParseInt(fields.Get("dztotalfilesize"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || index < 0 || index >= count || size < 0 {
+		return badRequestHandler(c, RespJSON, "Invalid chunk")
+	} else if size == 0 {
+		return badRequestHandler(c, RespJSON, backends.FileEmptyError.Error())
+	} else if size > Config.maxSize {
+		return badRequestHandler(c, RespJSON, FileTooLargeError.Error())
+	}
+
+	// the uuid is chosen by the client, the staging id is derived from it so
+	// it has the expected form
+	sum := sha256.Sum256([]byte(fields.Get("dzuuid")))
+	id := hex.EncodeToString(sum[:16])
+
+	unlock, err := lockStagedUpload(id)
+	if err != nil {
+		return badRequestHandler(c, RespJSON, err.Error())
+	}
+	defer unlock()
+
+	upload, err := loadStagedUpload(ctx, id)
+	if errors.Is(err, backends.NotFoundErr) && index == 0 {
+		upReq.size = size
+		upload, err = newStagedUpload(ctx, id, upReq)
+	}
+	if errors.Is(err, backends.NotFoundErr) {
+		return badRequestHandler(c, RespJSON, "Unknown upload")
+	} else if err != nil {
+		return oopsHandler(c, RespJSON, "Could not store chunk")
+	}
+	if upload.Length != size {
+		return badRequestHandler(c, RespJSON, "Chunk does not belong to this upload")
+	}
+
+	switch {
+	case upload.Result != "" || index < len(upload.Chunks):
+		// the response to a chunk that was already stored got lost
+	case index > len(upload.Chunks):
+		return badRequestHandler(c, RespJSON, "Chunks have to be sent in order")
+	default:
+		if offset := fields.Get("dzchunkbyteoffset"); offset != "" && offset != strconv.FormatInt(upload.offset(), 10) {
+			return badRequestHandler(c, RespJSON, "Chunk does not start where the previous one ended")
+		}
+
+		_, err = upload.appendChunk(ctx, upReq.src, fields.Get("dzchunksha256"))
+		if errors.Is(err, FileTooLargeError) || errors.Is(err, ChecksumMismatchError) {
+			return badRequestHandler(c, RespJSON, err.Error())
+		} else if err != nil {
+			return oopsHandler(c, RespJSON, "Could not store chunk")
+		}
+	}
+
+	if index < count-1 {
+		return c.JSON(http.StatusOK, map[string]string{
+			"offset": strconv.FormatInt(upload.offset(), 10),
+		})
+	}
+
+	if upload.Result != "" {
+		metadata, err := storageBackend.Head(ctx, upload.Result)
+		return uploadResponse(c, Upload{Filename: upload.Result, Metadata: metadata}, err)
+	}
+
+	if !upload.complete() {
+		upload.remove(context.WithoutCancel(ctx))
+		return badRequestHandler(c, RespJSON, "Received size does not match the file size")
+	}
+
+	result, err := upload.finish(context.WithoutCancel(ctx), fields.Get("dzfilesha256"))
+	if err != nil {
+		upload.remove(context.WithoutCancel(ctx))
+	}
+	if errors.Is(err, ChecksumMismatchError) {
+		return badRequestHandler(c, RespJSON, err.Error())
+	}
+	return uploadResponse(c, result, err)
+}
@@ -5,39 +5,30 @@ import (
 	"log"
 	"time"
 
-	"github.com/andreimarcu/linx-server/backends/localfs"
-	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/backends"
 )
 
-func Cleanup(filesDir string, metaDir string, noLogs bool) {
-	fileBackend := localfs.NewLocalfsBackend(metaDir, filesDir, 0)
-
-	files, err := fileBackend.List(context.Background())
+func Cleanup(backend backends.MetaStorageBackend, noLogs bool) {
+	files, err := backends.ListExpired(context.Background(), backend, time.Now())
 	if err != nil {
-		panic(err)
+		if !noLogs {
+			log.Printf("Failed to list expired files: %v", err)
+		}
+		return
 	}
 
 	for _, filename := range files {
-		metadata, err := fileBackend.Head(context.Background(), filename)
-		if err != nil {
-			if !noLogs {
-				log.Printf("Failed to find metadata for %s", filename)
-			}
-		}
-
-		if expiry.IsTsExpired(metadata.Expiry) {
-			if !noLogs {
-				log.Printf("Delete %s", filename)
-			}
-			fileBackend.Delete(context.Background(), filename)
+		if !noLogs {
+			log.Printf("Delete %s", filename)
 		}
+		backend.Delete(context.Background(), filename)
 	}
 }
 
-func PeriodicCleanup(minutes time.Duration, filesDir string, metaDir string, noLogs bool) {
+func PeriodicCleanup(minutes time.Duration, backend backends.MetaStorageBackend, noLogs bool) {
 	c := time.Tick(minutes)
 	for range c {
-		Cleanup(filesDir, metaDir, noLogs)
+		Cleanup(backend, noLogs)
 	}
 
 }
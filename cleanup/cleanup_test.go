@@ -0,0 +1,38 @@
+package cleanup
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func TestCleanup(t *testing.T) {
+	ctx := context.Background()
+	b := memory.NewMemoryBackend(0)
+
+	for key, expiry := range map[string]time.Time{
+		"expired.txt": time.Now().Add(-time.Minute),
+		"later.txt":   time.Now().Add(time.Hour),
+		"never.txt":   expiry.NeverExpire,
+	} {
+		_, err := b.Put(ctx, key, key, strings.NewReader("content"), expiry, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Cleanup(b, true)
+
+	if exists, _ := b.Exists(ctx, "expired.txt"); exists {
+		t.Fatal("Expired file was not deleted")
+	}
+	for _, key := range []string{"later.txt", "never.txt"} {
+		if exists, _ := b.Exists(ctx, key); !exists {
+			t.Fatalf("Cleanup deleted %s", key)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/dchest/uniuri"
+	"github.com/dustin/go-humanize"
+	"github.com/flosch/pongo2/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Collections group files that were uploaded together under their own URL.
+// A collection is stored like a file, as a manifest listing its files. It
+// gets a mimetype that no upload can get, so manifests can't be forged. The
+// files share the delete key of their collection and deleting the
+// collection deletes them too. It expires with the last of its files.
+
+const collectionMimetype = "application/vnd.linx.collection+json"
+const maxCollectionFiles = 1000
+
+// maxManifestSize limits how much of a manifest is read
+const maxManifestSize = 1 << 20
+
+var TooManyFilesError = errors.New("Too many files.")
+
+type collectionManifest struct {
+	Files []string `json:"files"`
+}
+
+// collectionFile describes a file on the page of its collection
+type collectionFile struct {
+	Filename     string
+	OriginalName string
+	Extension    string
+	Size         string
+	Image        bool
+}
+
+func isCollection(metadata backends.Metadata) bool {
+	return metadata.Mimetype == collectionMimetype
+}
+
+// createCollection stores the manifest of uploads that share the delete key
+// of upReq. The collection expires with the last of its files.
+func createCollection(upReq UploadRequest, title string, uploads []Upload) (collection Upload, err error) {
+	manifest := collectionManifest{}
+	fileExpiry := time.Time{}
+	for _, upload := range uploads {
+		manifest.Files = append(manifest.Files, upload.Filename)
+		if upload.Metadata.Expiry == expiry.NeverExpire || (fileExpiry != expiry.NeverExpire && upload.Metadata.Expiry.After(fileExpiry)) {
+			fileExpiry = upload.Metadata.Expiry
+		}
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return
+	}
+
+	if len(title) > 200 {
+		title = title[:200]
+	}
+	upReq.src = bytes.NewReader(data)
+	upReq.size = int64(len(data))
+	upReq.filename = title + ".collection"
+	collection, err = processUpload(upReq)
+	if err != nil {
+		return
+	}
+
+	collection.Metadata.Mimetype = collectionMimetype
+	collection.Metadata.OriginalName = title
+	collection.Metadata.Expiry = fileExpiry
+	err = storageBackend.PutMetadata(upReq.ctx, collection.Filename, collection.Metadata)
+	if err != nil {
+		storageBackend.Delete(context.WithoutCancel(upReq.ctx), collection.Filename)
+	}
+	return
+}
+
+func loadCollection(ctx context.Context, filename string) (manifest collectionManifest, err error) {
+	_, reader, err := storageBackend.Get(ctx, filename)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	err = json.NewDecoder(io.LimitReader(reader, maxManifestSize)).Decode(&manifest)
+	return
+}
+
+// deleteCollectionFiles deletes the files of a collection that still share
+// its delete key
+func deleteCollectionFiles(ctx context.Context, filename string, metadata backends.Metadata) error {
+	manifest, err := loadCollection(ctx, filename)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range manifest.Files {
+		fileMetadata, err := storageBackend.Head(ctx, name)
+		if err != nil || isCollection(fileMetadata) || fileMetadata.DeleteKey != metadata.DeleteKey {
+			continue
+		}
+		err = storageBackend.Delete(ctx, name)
+		if err != nil && err != backends.NotFoundErr {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadCollectionHandler makes a collection of files that were uploaded
+// one by one. The delete key of every file proves that it may be added, even
+// if anyone can delete files, as its metadata is changed. The files keep
+// their expiry unless a new one is given.
+func uploadCollectionHandler(c echo.Context) error {
+	r := c.Request()
+	ctx := r.Context()
+
+	if !strictReferrerCheck(r, getSiteURL(r), []string{"Linx-Delete-Key", "Linx-Expiry", "X-Requested-With"}) {
+		return badRequestHandler(c, RespAUTO, "")
+	}
+
+	upReq := UploadRequest{ctx: ctx}
+	uploadHeaderProcess(r, &upReq)
+
+	r.ParseMultipartForm(maxFieldSize)
+	names := r.Form["files"]
+	deleteKeys := r.Form["delete_keys"]
+	if len(names) == 0 {
+		return badRequestHandler(c, RespAUTO, "No files")
+	} else if len(names) > maxCollectionFiles {
+		return badRequestHandler(c, RespAUTO, TooManyFilesError.Error())
+	} else if len(deleteKeys) != len(names) {
+		return badRequestHandler(c, RespAUTO, "Every file needs its delete key")
+	}
+
+	cli := cliUserAgentRe.MatchString(r.Header.Get("User-Agent"))
+	setExpiry := r.Form.Has("expires") || r.Header.Get("Linx-Expiry") != ""
+	if r.Form.Has("expires") {
+		upReq.expiry = parseExpiry(r.Form.Get("expires"), cli)
+	}
+	if upReq.deleteKey == "" {
+		upReq.deleteKey = uniuri.NewLen(30)
+	}
+
+	var uploads []Upload
+	for i, name := range names {
+		metadata, err := checkFile(ctx, name)
+		if err == backends.NotFoundErr {
+			return badRequestHandler(c, RespAUTO, "File not found: "+name)
+		} else if err != nil {
+			return oopsHandler(c, RespAUTO, "Corrupt metadata.")
+		}
+		if isCollection(metadata) {
+			return badRequestHandler(c, RespAUTO, "Collections can't contain collections")
+		}
+		if metadata.DeleteKey == "" || metadata.DeleteKey != deleteKeys[i] {
+			return echo.ErrUnauthorized
+		}
+		uploads = append(uploads, Upload{Filename: name, Metadata: metadata})
+	}
+
+	fileExpiry := expiryTime(upReq.expiry)
+	members := make([]Upload, len(uploads))
+	for i, upload := range uploads {
+		upload.Metadata.DeleteKey = upReq.deleteKey
+		if setExpiry {
+			upload.Metadata.Expiry = fileExpiry
+		}
+		if r.Form.Has(accessKeyParamName) {
+			upload.Metadata.AccessKey = r.Form.Get(accessKeyParamName)
+		}
+		members[i] = upload
+	}
+
+	// the files are only changed once their collection exists, and changed
+	// back if not all of them can be
+	if r.Form.Has(accessKeyParamName) {
+		upReq.accessKey = r.Form.Get(accessKeyParamName)
+	}
+	collection, err := createCollection(upReq, r.Form.Get("collection"), members)
+	if err != nil {
+		return collectionResponse(c, collection, members, err)
+	}
+
+	for i, member := range members {
+		err := storageBackend.PutMetadata(ctx, member.Filename, member.Metadata)
+		if err != nil {
+			ctx := context.WithoutCancel(ctx)
+			for _, upload := range uploads[:i] {
+				storageBackend.PutMetadata(ctx, upload.Filename, upload.Metadata)
+			}
+			storageBackend.Delete(ctx, collection.Filename)
+			return oopsHandler(c, RespAUTO, "Could not update file: "+err.Error())
+		}
+	}
+	return collectionResponse(c, collection, members, nil)
+}
+
+// collectionResponse answers the creation of a collection like an upload,
+// the json also describes its files
+func collectionResponse(c echo.Context, collection Upload, uploads []Upload, err error) error {
+	r := c.Request()
+	if err != nil || !strings.EqualFold("application/json", r.Header.Get("Accept")) {
+		return uploadResponse(c, collection, err)
+	}
+
+	resp := map[string]any{}
+	for k, v := range generateJSONresponse(collection, r) {
+		resp[k] = v
+	}
+	files := []map[string]string{}
+	for _, upload := range uploads {
+		files = append(files, generateJSONresponse(upload, r))
+	}
+	resp["files"] = files
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func collectionDisplayHandler(c echo.Context, fileName string, metadata backends.Metadata) error {
+	r := c.Request()
+	ctx := r.Context()
+
+	manifest, err := loadCollection(ctx, fileName)
+	if err != nil {
+		return oopsHandler(c, RespAUTO, "Corrupt collection.")
+	}
+
+	var files []collectionFile
+	var jsonFiles []map[string]string
+	var totalSize int64
+	for _, name := range manifest.Files {
+		fileMetadata, err := checkFile(ctx, name)
+		if err != nil {
+			continue
+		}
+
+		// files protected with the key of the collection can be seen with
+		// it, others only show their name until their own key is given
+		locked := fileMetadata.AccessKey != ""
+		if locked && fileMetadata.AccessKey == metadata.AccessKey {
+			setAccessKeyCookies(c.Response().Writer, getSiteURL(r), name, fileMetadata.AccessKey, accessKeyCookieExpiry())
+			locked = false
+		} else if locked {
+			_, err := checkAccessKey(r, &fileMetadata)
+			locked = err != nil
+		}
+
+		jsonFile := map[string]string{
+			"filename":   name,
+			"url":        getSiteURL(r) + name,
+			"direct_url": getSiteURL(r) + Config.selifPath + name,
+		}
+		file := collectionFile{
+			Filename:     name,
+			OriginalName: name,
+			Extension:    strings.TrimPrefix(path.Ext(name), "."),
+		}
+		if !locked {
+			if fileMetadata.OriginalName != "" {
+				file.OriginalName = fileMetadata.OriginalName
+			}
+			file.Size = humanize.Bytes(uint64(fileMetadata.Size))
+			file.Image = strings.HasPrefix(fileMetadata.Mimetype, "image/")
+			jsonFile["original_name"] = fileMetadata.OriginalName
+			jsonFile["size"] = strconv.FormatInt(fileMetadata.Size, 10)
+			jsonFile["mimetype"] = fileMetadata.Mimetype
+			totalSize += fileMetadata.Size
+		}
+		files = append(files, file)
+		jsonFiles = append(jsonFiles, jsonFile)
+	}
+
+	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
+		return c.JSON(http.StatusOK, map[string]any{
+			"original_name": metadata.OriginalName,
+			"filename":      fileName,
+			"expiry":        strconv.FormatInt(metadata.Expiry.Unix(), 10),
+			"mimetype":      metadata.Mimetype,
+			"created_at":    strconv.FormatInt(backends.UnixTimestamp(metadata.CreatedAt), 10),
+			"files":         jsonFiles,
+		})
+	}
+
+	var expiryHuman string
+	if metadata.Expiry != expiry.NeverExpire {
+		expiryHuman = humanize.RelTime(time.Now(), metadata.Expiry, "", "")
+	}
+	var uploadedHuman string
+	if !metadata.CreatedAt.IsZero() {
+		uploadedHuman = humanize.Time(metadata.CreatedAt)
+	}
+	title := metadata.OriginalName
+	if title == "" {
+		title = strconv.Itoa(len(files)) + " files"
+	}
+
+	return c.Render(http.StatusOK, "display/collection.html", pongo2.Context{
+		"mime":           metadata.Mimetype,
+		"original_name":  title,
+		"filename":       fileName,
+		"size":           humanize.Bytes(uint64(totalSize)),
+		"expiry":         expiryHuman,
+		"uploaded":       uploadedHuman,
+		"collection":     files,
+		"siteurl":        strings.TrimSuffix(getSiteURL(r), "/"),
+		"keyless_delete": Config.anyoneCanDelete,
+	})
+}
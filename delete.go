@@ -11,6 +11,9 @@ func deleteHandler(c echo.Context) error {
 	requestKey := c.Request().Header.Get("Linx-Delete-Key")
 
 	filename := c.Param("name")
+	if isStagingName(filename) {
+		return echo.ErrNotFound
+	}
 
 	// Ensure that file exists and delete key is correct
 	metadata, err := storageBackend.Head(c.Request().Context(), filename)
@@ -21,6 +24,13 @@ func deleteHandler(c echo.Context) error {
 	}
 
 	if Config.anyoneCanDelete || metadata.DeleteKey == requestKey {
+		if isCollection(metadata) {
+			err = deleteCollectionFiles(c.Request().Context(), filename, metadata)
+			if err != nil {
+				return oopsHandler(c, RespPLAIN, "Could not delete")
+			}
+		}
+
 		err = storageBackend.Delete(c.Request().Context(), filename)
 		if err != nil {
 			return oopsHandler(c, RespPLAIN, "Could not delete")
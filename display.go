@@ -22,10 +22,18 @@ const maxDisplayFileSizeBytes = 1024 * 512
 func fileDisplayHandler(c echo.Context, fileName string, metadata backends.Metadata) error {
 	r := c.Request()
 
+	if isCollection(metadata) {
+		return collectionDisplayHandler(c, fileName, metadata)
+	}
+
 	var expiryHuman string
 	if metadata.Expiry != expiry.NeverExpire {
 		expiryHuman = humanize.RelTime(time.Now(), metadata.Expiry, "", "")
 	}
+	var uploadedHuman string
+	if !metadata.CreatedAt.IsZero() {
+		uploadedHuman = humanize.Time(metadata.CreatedAt)
+	}
 	sizeHuman := humanize.Bytes(uint64(metadata.Size))
 	extra := make(map[string]string)
 	var lines []string
@@ -34,13 +42,15 @@ func fileDisplayHandler(c echo.Context, fileName string, metadata backends.Metad
 
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
 		return c.JSON(http.StatusOK, map[string]string{
-			"original_name": metadata.OriginalName,
-			"filename":      fileName,
-			"direct_url":    getSiteURL(r) + Config.selifPath + fileName,
-			"expiry":        strconv.FormatInt(metadata.Expiry.Unix(), 10),
-			"size":          strconv.FormatInt(metadata.Size, 10),
-			"mimetype":      metadata.Mimetype,
-			"sha256sum":     metadata.Sha256sum,
+			"original_name":    metadata.OriginalName,
+			"filename":         fileName,
+			"direct_url":       getSiteURL(r) + Config.selifPath + fileName,
+			"expiry":           strconv.FormatInt(metadata.Expiry.Unix(), 10),
+			"size":             strconv.FormatInt(metadata.Size, 10),
+			"mimetype":         metadata.Mimetype,
+			"sha256sum":        metadata.Sha256sum,
+			"created_at":       strconv.FormatInt(backends.UnixTimestamp(metadata.CreatedAt), 10),
+			"last_accessed_at": strconv.FormatInt(backends.UnixTimestamp(metadata.LastAccessedAt), 10),
 		})
 	}
 
@@ -128,6 +138,7 @@ func fileDisplayHandler(c echo.Context, fileName string, metadata backends.Metad
 		"filename":       fileName,
 		"size":           sizeHuman,
 		"expiry":         expiryHuman,
+		"uploaded":       uploadedHuman,
 		"expirylist":     listExpirationTimes(),
 		"extra":          extra,
 		"lines":          lines,
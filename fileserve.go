@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
@@ -14,6 +15,20 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+const accessTimeResolution = time.Hour
+
+// hotlinked reports whether a request for a file comes from a page of
+// another site while hotlinking is not allowed
+func hotlinked(r *http.Request) bool {
+	if Config.allowHotlink {
+		return false
+	}
+	referer := r.Header.Get("Referer")
+	u, _ := url.Parse(referer)
+	p, _ := url.Parse(getSiteURL(r))
+	return referer != "" && !sameOrigin(u, p)
+}
+
 func fileServeHandler(c echo.Context) error {
 	fileName := c.Param("name")
 
@@ -35,13 +50,8 @@ func fileServeHandler(c echo.Context) error {
 		return echo.ErrUnauthorized
 	}
 
-	if !Config.allowHotlink {
-		referer := r.Header.Get("Referer")
-		u, _ := url.Parse(referer)
-		p, _ := url.Parse(getSiteURL(r))
-		if referer != "" && !sameOrigin(u, p) {
-			return c.Redirect(303, Config.sitePath+fileName)
-		}
+	if hotlinked(r) {
+		return c.Redirect(303, Config.sitePath+fileName)
 	}
 
 	if Config.fileContentSecurityPolicy != "" {
@@ -59,7 +69,10 @@ func fileServeHandler(c echo.Context) error {
 	c.Response().Header().Set("Etag", fmt.Sprintf("\"%s\"", metadata.Sha256sum))
 	c.Response().Header().Set("Cache-Control", "public, no-cache")
 
-	modtime := time.Unix(0, 0)
+	modtime := metadata.CreatedAt
+	if !modtime.IsZero() {
+		c.Response().Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
 	if done := httputil.CheckPreconditions(w, r, modtime); done == true {
 		return nil
 	}
@@ -69,12 +82,31 @@ func fileServeHandler(c echo.Context) error {
 		if err != nil {
 			return oopsHandler(c, RespAUTO, err.Error())
 		}
+		markAccessed(c.Request().Context(), fileName, metadata)
 	}
 
 	return nil
 }
 
+// markAccessed records when a file was last downloaded. To keep downloads
+// from writing the metadata every time it is only updated once per
+// accessTimeResolution. Only the access time is written, so changes made to
+// the metadata since it was read are kept.
+func markAccessed(ctx context.Context, fileName string, metadata backends.Metadata) {
+	now := time.Now()
+	if now.Sub(metadata.LastAccessedAt) < accessTimeResolution {
+		return
+	}
+
+	go backends.MarkAccessed(context.WithoutCancel(ctx), storageBackend, fileName, now)
+}
+
 func checkFile(ctx context.Context, filename string) (metadata backends.Metadata, err error) {
+	if isStagingName(filename) || isHeldUpload(filename) {
+		err = backends.NotFoundErr
+		return
+	}
+
 	metadata, err = storageBackend.Head(ctx, filename)
 	if err != nil {
 		return
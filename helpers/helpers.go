@@ -3,6 +3,7 @@ package helpers
 import (
 	"bytes"
 	"encoding/hex"
+	"hash"
 	"io"
 	"unicode"
 
@@ -86,3 +87,40 @@ func printable(data []byte) bool {
 
 	return true
 }
+
+// MetadataReader computes the size, checksum and mimetype of everything that
+// is read through it, so metadata can be generated while a file is stored.
+type MetadataReader struct {
+	r      io.Reader
+	hasher hash.Hash
+	header []byte
+	size   int64
+}
+
+func NewMetadataReader(r io.Reader) *MetadataReader {
+	return &MetadataReader{
+		r:      r,
+		hasher: sha256.New(),
+		header: make([]byte, 0, MimetypeDetectLimit),
+	}
+}
+
+func (mr *MetadataReader) Read(p []byte) (n int, err error) {
+	n, err = mr.r.Read(p)
+	if n > 0 {
+		mr.hasher.Write(p[:n])
+		mr.size += int64(n)
+		if missing := cap(mr.header) - len(mr.header); missing > 0 {
+			mr.header = append(mr.header, p[:min(n, missing)]...)
+		}
+	}
+	return
+}
+
+// Metadata returns the metadata of the bytes read so far
+func (mr *MetadataReader) Metadata() (m backends.Metadata) {
+	m.Size = mr.size
+	m.Sha256sum = hex.EncodeToString(mr.hasher.Sum(nil))
+	m.Mimetype = mimetype.Detect(mr.header).String()
+	return
+}
@@ -2,6 +2,7 @@ package helpers
 
 import (
 	"bytes"
+	"io"
 	"strings"
 	"testing"
 	"unicode/utf16"
@@ -30,6 +31,32 @@ func TestGenerateMetadata(t *testing.T) {
 	}
 }
 
+func TestMetadataReader(t *testing.T) {
+	content := strings.Repeat("This is my test content", 1000)
+	expected, err := GenerateMetadata(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr := NewMetadataReader(strings.NewReader(content))
+	if _, err := io.Copy(io.Discard, mr); err != nil {
+		t.Fatal(err)
+	}
+	m := mr.Metadata()
+
+	if m.Sha256sum != expected.Sha256sum {
+		t.Fatalf("Sha256sum was %q instead of expected value of %q", m.Sha256sum, expected.Sha256sum)
+	}
+
+	if m.Mimetype != expected.Mimetype {
+		t.Fatalf("Mimetype was %q instead of expected value of %q", m.Mimetype, expected.Mimetype)
+	}
+
+	if m.Size != expected.Size {
+		t.Fatalf("Size was %d instead of expected value of %d", m.Size, expected.Size)
+	}
+}
+
 func TestTextCharsets(t *testing.T) {
 	// verify that different text encodings are detected and passed through
 	orig := "This is a text string"
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/s3"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+type store struct {
+	filesDir         string
+	metaDir          string
+	sharded          bool
+	dedup            bool
+	s3Bucket         string
+	s3Region         string
+	s3Endpoint       string
+	s3ForcePathStyle bool
+}
+
+func (s *store) register(prefix, name string) {
+	flag.StringVar(&s.filesDir, prefix+"filespath", "",
+		"path to the files directory of the "+name)
+	flag.StringVar(&s.metaDir, prefix+"metapath", "",
+		"path to the metadata directory of the "+name)
+	flag.BoolVar(&s.sharded, prefix+"sharded", false,
+		"the "+name+" uses the sharded layout (localfs-sharded)")
+	flag.BoolVar(&s.dedup, prefix+"dedup", false,
+		"the "+name+" deduplicates identical files (localfs-dedup)")
+	flag.StringVar(&s.s3Bucket, prefix+"s3-bucket", "",
+		"S3 bucket of the "+name)
+	flag.StringVar(&s.s3Region, prefix+"s3-region", "",
+		"S3 region of the "+name)
+	flag.StringVar(&s.s3Endpoint, prefix+"s3-endpoint", "",
+		"S3 endpoint of the "+name)
+	flag.BoolVar(&s.s3ForcePathStyle, prefix+"s3-force-path-style", false,
+		"Force path-style addressing for the S3 bucket of the "+name)
+}
+
+func (s *store) open(name string) backends.MetaStorageBackend {
+	if s.s3Bucket != "" {
+		return s3.NewS3Backend(s.s3Bucket, s.s3Region, s.s3Endpoint, s.s3ForcePathStyle, 0)
+	}
+
+	if s.filesDir == "" || s.metaDir == "" {
+		log.Fatalf("Either an S3 bucket or the files and metadata paths of the %s are required", name)
+	}
+	for _, dir := range []string{s.filesDir, s.metaDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Fatal("Could not create directory:", err)
+		}
+	}
+	return localfs.NewLocalfsBackend(s.metaDir, s.filesDir, 0, s.dedup, s.sharded)
+}
+
+// migrated reports whether the destination already holds the same file
+func migrated(ctx context.Context, key string, metadata backends.Metadata, src, dst backends.StorageBackend) bool {
+	existing, err := dst.Head(ctx, key)
+	if err != nil || existing.Sha256sum != metadata.Sha256sum || existing.Encoding != metadata.Encoding {
+		return false
+	}
+
+	srcSize, err := src.Size(ctx, key)
+	if err != nil {
+		return false
+	}
+	dstSize, err := dst.Size(ctx, key)
+	return err == nil && srcSize == dstSize
+}
+
+func main() {
+	var src, dst store
+	var workers int
+	var includeExpired bool
+	var noLogs bool
+
+	src.register("src-", "source")
+	dst.register("dst-", "destination")
+	flag.IntVar(&workers, "workers", 4,
+		"number of files to copy at the same time")
+	flag.BoolVar(&includeExpired, "include-expired", false,
+		"also copy files that have already expired")
+	flag.BoolVar(&noLogs, "nologs", false,
+		"don't log copied files")
+	flag.Parse()
+
+	from := src.open("source")
+	to := dst.open("destination")
+	ctx := context.Background()
+
+	files, err := from.List(ctx)
+	if err != nil {
+		log.Fatal("Could not list source files:", err)
+	}
+	// unfinished resumable uploads can't be resumed from the copies
+	files = slices.DeleteFunc(files, backends.IsStaging)
+	sort.Strings(files)
+
+	var copied, skipped, failed int64
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				metadata, err := from.Head(ctx, key)
+				if err != nil {
+					log.Printf("Failed to read metadata of %s: %v", key, err)
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+
+				if (!includeExpired && expiry.IsTsExpired(metadata.Expiry)) || migrated(ctx, key, metadata, from, to) {
+					atomic.AddInt64(&skipped, 1)
+					continue
+				}
+
+				err = backends.Copy(ctx, key, from, to)
+				if err != nil {
+					log.Printf("Failed to copy %s: %v", key, err)
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				atomic.AddInt64(&copied, 1)
+				if !noLogs {
+					log.Printf("Copied %s", key)
+				}
+			}
+		}()
+	}
+
+	for _, key := range files {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+
+	log.Printf("Copied %d files, skipped %d, %d failed", copied, skipped, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func TestMigrated(t *testing.T) {
+	ctx := context.Background()
+	src := memory.NewMemoryBackend(0)
+	dst := memory.NewMemoryBackend(0)
+
+	metadata, err := src.Put(ctx, "a.txt", "a.txt", strings.NewReader("content"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated(ctx, "a.txt", metadata, src, dst) {
+		t.Fatal("Missing file counts as migrated")
+	}
+
+	_, err = dst.Put(ctx, "a.txt", "a.txt", strings.NewReader("other"), expiry.NeverExpire, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated(ctx, "a.txt", metadata, src, dst) {
+		t.Fatal("Different file counts as migrated")
+	}
+
+	err = backends.Copy(ctx, "a.txt", src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !migrated(ctx, "a.txt", metadata, src, dst) {
+		t.Fatal("Copied file is copied again")
+	}
+}
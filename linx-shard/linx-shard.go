@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/andreimarcu/linx-server/backends/localfs"
+)
+
+func main() {
+	var filesDir string
+	var metaDir string
+
+	flag.StringVar(&filesDir, "filespath", "files/",
+		"path to files directory")
+	flag.StringVar(&metaDir, "metapath", "meta/",
+		"path to metadata directory")
+	flag.Parse()
+
+	moved, err := localfs.Shard(metaDir, filesDir)
+	if err != nil {
+		log.Fatalf("Sharding stopped after moving %d files: %v", moved, err)
+	}
+
+	log.Printf("Moved %d files into the sharded layout", moved)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/s3"
+)
+
+func main() {
+	var filesDir string
+	var metaDir string
+	var s3Bucket string
+	var s3Region string
+	var s3Endpoint string
+	var s3ForcePathStyle bool
+	var sharded bool
+	var noLogs bool
+
+	flag.StringVar(&filesDir, "filespath", "files/",
+		"path to files directory")
+	flag.StringVar(&metaDir, "metapath", "meta/",
+		"path to metadata directory")
+	flag.BoolVar(&sharded, "sharded", false,
+		"files are stored in the sharded layout (localfs-sharded)")
+	flag.StringVar(&s3Bucket, "s3-bucket", "",
+		"S3 bucket to upgrade instead of the local directories")
+	flag.StringVar(&s3Region, "s3-region", "",
+		"S3 region")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "",
+		"S3 endpoint")
+	flag.BoolVar(&s3ForcePathStyle, "s3-force-path-style", false,
+		"Force path-style addressing for S3 (e.g. https://s3.amazonaws.com/linx/example.txt)")
+	flag.BoolVar(&noLogs, "nologs", false,
+		"don't log upgraded files")
+	flag.Parse()
+
+	var backend backends.MetaStorageBackend
+	if s3Bucket != "" {
+		backend = s3.NewS3Backend(s3Bucket, s3Region, s3Endpoint, s3ForcePathStyle, 0)
+	} else {
+		backend = localfs.NewLocalfsBackend(metaDir, filesDir, 0, false, sharded)
+	}
+
+	ctx := context.Background()
+	files, err := backend.List(ctx)
+	if err != nil {
+		log.Fatal("Could not list files:", err)
+	}
+
+	// reading metadata upgrades it, writing it back stores the result in
+	// the latest version
+	upgraded, failed := 0, 0
+	for _, key := range files {
+		metadata, err := backend.Head(ctx, key)
+		if err == nil {
+			err = backend.PutMetadata(ctx, key, metadata)
+		}
+		if err != nil {
+			log.Printf("Failed to upgrade %s: %v", key, err)
+			failed++
+			continue
+		}
+
+		upgraded++
+		if !noLogs {
+			log.Printf("Upgraded %s", key)
+		}
+	}
+
+	log.Printf("Upgraded the metadata of %d files to version %d, %d failed", upgraded, backends.MetadataVersion, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
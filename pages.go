@@ -19,8 +19,10 @@ const (
 
 func indexHandler(c echo.Context) error {
 	return c.Render(http.StatusOK, "index.html", pongo2.Context{
-		"maxsize":    Config.maxSize,
-		"expirylist": listExpirationTimes(),
+		"maxsize":       Config.maxSize,
+		"chunksize":     Config.chunkSize,
+		"remoteuploads": Config.remoteUploads,
+		"expirylist":    listExpirationTimes(),
 	})
 }
 
@@ -34,6 +36,7 @@ func apiDocHandler(c echo.Context) error {
 	return c.Render(http.StatusOK, "API.html", pongo2.Context{
 		"siteurl":        getSiteURL(c.Request()),
 		"keyless_delete": Config.anyoneCanDelete,
+		"remoteuploads":  Config.remoteUploads,
 	})
 }
 
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Remote uploads fetch a file from a URL given by the client. Every
+// connection is checked against the allowed networks when it is made, so
+// neither redirects nor DNS tricks can reach the internal network.
+
+var RemoteDestinationError = errors.New("destination is not allowed")
+
+// privateNetworks can only be fetched from if they are allowed explicitly
+var privateNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	// multicast, the reserved 240.0.0.0/4 and broadcast
+	netip.MustParsePrefix("224.0.0.0/3"),
+	// IPv4-compatible, IPv4-mapped, NAT64, Teredo and 6to4 addresses embed
+	// IPv4 addresses, which may be private
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("::ffff:0:0/96"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2001::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+var remoteAllowed, remoteDenied []netip.Prefix
+var remoteClient *http.Client
+
+// parseNetworks reads a list of networks in CIDR notation or single addresses
+func parseNetworks(list []string) ([]netip.Prefix, error) {
+	var networks []netip.Prefix
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			network, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network.Masked())
+		} else {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return networks, nil
+}
+
+// remoteAddrAllowed reports whether files may be fetched from addr. Allowed
+// networks take precedence over private and denied ones.
+func remoteAddrAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, network := range remoteAllowed {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	for _, networks := range [][]netip.Prefix{privateNetworks, remoteDenied} {
+		for _, network := range networks {
+			if network.Contains(addr) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func newRemoteClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		// runs for the resolved address of every connection
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil || !remoteAddrAllowed(addr) {
+				return RemoteDestinationError
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: time.Duration(Config.remoteUploadTimeout) * time.Second,
+		Transport: &http.Transport{
+			// a proxy would connect on our behalf, unchecked
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			ForceAttemptHTTP2:   true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > Config.remoteUploadMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return RemoteDestinationError
+			}
+			return nil
+		},
+	}
+}
+
+func uploadRemoteHandler(c echo.Context) error {
+	r := c.Request()
+
+	if !Config.remoteUploads {
+		return echo.ErrNotFound
+	}
+	if !strictReferrerCheck(r, getSiteURL(r), []string{"Linx-Delete-Key", "Linx-Expiry", "X-Requested-With"}) {
+		return badRequestHandler(c, RespAUTO, "")
+	}
+
+	upReq := UploadRequest{ctx: r.Context()}
+	uploadHeaderProcess(r, &upReq)
+
+	u, err := url.Parse(r.FormValue("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return badRequestHandler(c, RespAUTO, "Invalid URL")
+	}
+	cli := cliUserAgentRe.MatchString(r.Header.Get("User-Agent"))
+	if r.Form.Has("expires") {
+		upReq.expiry = parseExpiry(r.Form.Get("expires"), cli)
+	}
+	if r.Form.Has(accessKeyParamName) {
+		upReq.accessKey = r.Form.Get(accessKeyParamName)
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return badRequestHandler(c, RespAUTO, "Invalid URL")
+	}
+	req.Header.Set("User-Agent", "linx-server")
+
+	resp, err := remoteClient.Do(req)
+	if errors.Is(err, RemoteDestinationError) {
+		return badRequestHandler(c, RespAUTO, "Could not fetch URL: "+RemoteDestinationError.Error())
+	} else if err != nil {
+		return badRequestHandler(c, RespAUTO, "Could not fetch URL: "+err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return badRequestHandler(c, RespAUTO, fmt.Sprintf("Could not fetch URL: the server responded with %s", resp.Status))
+	}
+
+	upReq.src = resp.Body
+	upReq.size = resp.ContentLength
+	upReq.filename = remoteFilename(resp)
+
+	upload, err := processUpload(upReq)
+	return uploadResponse(c, upload, err)
+}
+
+// remoteFilename is the name the server suggests for a file or the last part
+// of its URL
+func remoteFilename(resp *http.Response) string {
+	name := path.Base(resp.Request.URL.Path)
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = path.Base(params["filename"])
+	}
+
+	if name == "/" || name == "." {
+		return ""
+	}
+	if len(name) > 255 {
+		name = name[len(name)-255:]
+	}
+	return name
+}
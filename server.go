@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"encoding/hex"
 	"flag"
 	"log"
 	"net"
@@ -11,13 +13,22 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/compressed"
+	"github.com/andreimarcu/linx-server/backends/encrypted"
 	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/backends/metastore"
+	"github.com/andreimarcu/linx-server/backends/mirror"
+	"github.com/andreimarcu/linx-server/backends/quota"
 	"github.com/andreimarcu/linx-server/backends/s3"
+	"github.com/andreimarcu/linx-server/backends/sqlite"
+	"github.com/andreimarcu/linx-server/backends/tiered"
 	"github.com/andreimarcu/linx-server/cleanup"
 	"github.com/andreimarcu/linx-server/helpers"
 	"github.com/labstack/echo/v4"
@@ -52,8 +63,10 @@ var Config struct {
 	fileReferrerPolicy        string
 	xFrameOptions             string
 	maxSize                   int64
+	chunkSize                 int64
 	maxExpiry                 uint64
 	defaultExpiryCli          uint64
+	stagingExpiry             uint64
 	realIp                    bool
 	noLogs                    bool
 	allowHotlink              bool
@@ -69,8 +82,32 @@ var Config struct {
 	customPagesDir            string
 	cleanupEveryMinutes       uint64
 	forbiddenExtensions       headerList
+	remoteUploads             bool
+	remoteUploadTimeout       uint64
+	remoteUploadMaxRedirects  int
+	remoteUploadAllow         headerList
+	remoteUploadDeny          headerList
 	pprofBind                 string
 	minFreeSpaceGB            float64
+	localfsDedup              bool
+	localfsSharded            bool
+	tieredStorage             bool
+	tieredMigrateAfterHours   uint64
+	tieredMigrateEveryMinutes uint64
+	mirrorPaths               headerList
+	mirrorRepairEveryMinutes  uint64
+	encryptionKey             string
+	compressFiles             bool
+	sqliteMetadata            string
+	sqliteImport              bool
+	s3PresignRedirectSeconds  uint64
+	memoryStorage             bool
+	memoryMaxSize             int64
+	quotaBytes                int64
+	quotaFiles                int64
+	quotaEviction             string
+	quotaResyncEveryMinutes   uint64
+	quotaStagingBytes         int64
 }
 
 //go:embed static templates
@@ -139,14 +176,16 @@ func setup() *echo.Echo {
 	}
 
 	// make directories if needed
-	err := os.MkdirAll(Config.filesDir, 0755)
-	if err != nil {
-		log.Fatal("Could not create files directory:", err)
-	}
+	if !Config.memoryStorage {
+		err := os.MkdirAll(Config.filesDir, 0755)
+		if err != nil {
+			log.Fatal("Could not create files directory:", err)
+		}
 
-	err = os.MkdirAll(Config.metaDir, 0700)
-	if err != nil {
-		log.Fatal("Could not create metadata directory:", err)
+		err = os.MkdirAll(Config.metaDir, 0700)
+		if err != nil {
+			log.Fatal("Could not create metadata directory:", err)
+		}
 	}
 
 	if Config.siteURL != "" {
@@ -173,14 +212,115 @@ func setup() *echo.Echo {
 		Config.selifPath = "selif/"
 	}
 
-	if Config.s3Bucket != "" {
-		storageBackend = s3.NewS3Backend(Config.s3Bucket, Config.s3Region, Config.s3Endpoint, Config.s3ForcePathStyle)
-	} else {
-		storageBackend = localfs.NewLocalfsBackend(Config.metaDir, Config.filesDir, Config.minFreeSpaceGB)
-		if Config.cleanupEveryMinutes > 0 {
-			go cleanup.PeriodicCleanup(time.Duration(Config.cleanupEveryMinutes)*time.Minute, Config.filesDir, Config.metaDir, Config.noLogs)
+	if Config.remoteUploads {
+		var err error
+		remoteAllowed, err = parseNetworks(Config.remoteUploadAllow)
+		if err != nil {
+			log.Fatal("Could not parse remote-upload-allow:", err)
+		}
+		remoteDenied, err = parseNetworks(Config.remoteUploadDeny)
+		if err != nil {
+			log.Fatal("Could not parse remote-upload-deny:", err)
+		}
+		remoteClient = newRemoteClient()
+	}
+
+	// with a separate metadata store only the files are kept in the
+	// storage backends
+	metaDir := Config.metaDir
+	if Config.sqliteMetadata != "" {
+		metaDir = ""
+	}
+
+	if Config.tieredStorage && (Config.s3Bucket == "" || Config.memoryStorage) {
+		log.Fatal("Tiered storage needs an s3-bucket as its cold tier")
+	}
+
+	backend := newStorageBackend(metaDir)
+	if !Config.memoryStorage && (Config.s3Bucket == "" || Config.tieredStorage) {
+		recoverLocalfs(localfs.NewLocalfsBackend(metaDir, Config.filesDir, 0, Config.localfsDedup, Config.localfsSharded))
+	}
+	if tieredBackend, ok := backend.(tiered.TieredBackend); ok && Config.tieredMigrateEveryMinutes > 0 {
+		go tieredBackend.PeriodicMigrate(time.Duration(Config.tieredMigrateEveryMinutes)*time.Minute, Config.noLogs)
+	}
+
+	if len(Config.mirrorPaths) > 0 {
+		replicas := []backends.MetaStorageBackend{backend}
+		for _, mirrorPath := range Config.mirrorPaths {
+			mirrorFilesDir := path.Join(mirrorPath, "files")
+			mirrorMetaDir := ""
+			if err := os.MkdirAll(mirrorFilesDir, 0755); err != nil {
+				log.Fatal("Could not create mirror files directory:", err)
+			}
+			if metaDir != "" {
+				mirrorMetaDir = path.Join(mirrorPath, "meta")
+				if err := os.MkdirAll(mirrorMetaDir, 0700); err != nil {
+					log.Fatal("Could not create mirror metadata directory:", err)
+				}
+			}
+			replica := localfs.NewLocalfsBackend(mirrorMetaDir, mirrorFilesDir, 0, Config.localfsDedup, Config.localfsSharded)
+			recoverLocalfs(replica)
+			replicas = append(replicas, replica)
+		}
+
+		mirrorBackend := mirror.NewMirrorBackend(replicas)
+		backend = mirrorBackend
+		if Config.mirrorRepairEveryMinutes > 0 {
+			go mirrorBackend.PeriodicRepair(time.Duration(Config.mirrorRepairEveryMinutes)*time.Minute, Config.noLogs)
+		}
+	}
+
+	if Config.sqliteMetadata != "" {
+		store, err := sqlite.NewSqliteMetaStore(Config.sqliteMetadata)
+		if err != nil {
+			log.Fatal("Could not open metadata database:", err)
 		}
 
+		metaStoreBackend := metastore.NewMetaStoreBackend(backend, store)
+		if Config.sqliteImport {
+			imported, err := metaStoreBackend.Import(context.Background(), newStorageBackend(Config.metaDir))
+			if err != nil {
+				log.Fatal("Could not import metadata:", err)
+			}
+			log.Printf("Imported metadata of %d files", imported)
+		}
+		backend = metaStoreBackend
+	}
+
+	if Config.quotaBytes > 0 || Config.quotaFiles > 0 {
+		stagingBytes := Config.quotaStagingBytes
+		if stagingBytes == 0 {
+			stagingBytes = Config.quotaBytes
+		}
+		quotaBackend, err := quota.NewQuotaBackend(backend, Config.quotaBytes, Config.quotaFiles, Config.quotaEviction, stagingPrefix, stagingBytes, Config.noLogs)
+		if err != nil {
+			log.Fatal("Could not set up storage quota:", err)
+		}
+		backend = quotaBackend
+		if Config.quotaResyncEveryMinutes > 0 {
+			go quotaBackend.PeriodicResync(time.Duration(Config.quotaResyncEveryMinutes)*time.Minute, Config.noLogs)
+		}
+	}
+
+	if Config.encryptionKey != "" {
+		key, err := hex.DecodeString(Config.encryptionKey)
+		if err != nil {
+			log.Fatal("Could not parse encryption key:", err)
+		}
+
+		backend, err = encrypted.NewEncryptedBackend(backend, key)
+		if err != nil {
+			log.Fatal("Could not set up encryption:", err)
+		}
+	}
+
+	if Config.compressFiles {
+		backend = compressed.NewCompressedBackend(backend)
+	}
+
+	storageBackend = backend
+	if Config.cleanupEveryMinutes > 0 {
+		go cleanup.PeriodicCleanup(time.Duration(Config.cleanupEveryMinutes)*time.Minute, backend, Config.noLogs)
 	}
 
 	// Template setup
@@ -211,6 +351,18 @@ func setup() *echo.Echo {
 	g.PUT("/upload/", uploadPutHandler)
 	g.PUT("/upload/:name", uploadPutHandler)
 
+	g.POST("/upload/remote", uploadRemoteHandler)
+	g.POST("/upload/collection", uploadCollectionHandler)
+
+	g.POST("/upload/tus", tusCreateHandler)
+	g.POST("/upload/tus/", tusCreateHandler)
+	g.OPTIONS("/upload/tus", tusOptionsHandler)
+	g.OPTIONS("/upload/tus/", tusOptionsHandler)
+	g.OPTIONS("/upload/tus/:id", tusOptionsHandler)
+	g.HEAD("/upload/tus/:id", tusHeadHandler)
+	g.PATCH("/upload/tus/:id", tusPatchHandler)
+	g.DELETE("/upload/tus/:id", tusDeleteHandler)
+
 	g.DELETE("/:name", deleteHandler)
 
 	staticMiddleware := AddHeaders([]string{"Cache-Control: public, max-age=1800"})
@@ -228,6 +380,8 @@ func setup() *echo.Echo {
 	g.GET("/:name", fileAccessHandler)
 	g.POST("/:name", fileAccessHandler)
 	g.GET("/"+Config.selifPath+":name", fileServeHandler)
+	g.GET("/:name/zip", zipCollectionHandler)
+	g.GET("/zip", zipFilesHandler)
 
 	if Config.customPagesDir != "" {
 		initializeCustomPages(Config.customPagesDir)
@@ -257,6 +411,31 @@ func setup() *echo.Echo {
 	return e
 }
 
+// recoverLocalfs cleans up after uploads that were interrupted by a crash
+func recoverLocalfs(b localfs.LocalfsBackend) {
+	removed, err := b.Recover()
+	if err != nil {
+		log.Printf("Could not clean up interrupted uploads: %v", err)
+	} else if removed > 0 && !Config.noLogs {
+		log.Printf("Removed %d leftovers of interrupted uploads", removed)
+	}
+}
+
+// newStorageBackend creates the backend that actually stores the files
+func newStorageBackend(metaDir string) backends.MetaStorageBackend {
+	if Config.memoryStorage {
+		return memory.NewMemoryBackend(Config.memoryMaxSize)
+	} else if Config.s3Bucket != "" && Config.tieredStorage {
+		hotBackend := localfs.NewLocalfsBackend(metaDir, Config.filesDir, Config.minFreeSpaceGB, Config.localfsDedup, Config.localfsSharded)
+		coldBackend := s3.NewS3Backend(Config.s3Bucket, Config.s3Region, Config.s3Endpoint, Config.s3ForcePathStyle, time.Duration(Config.s3PresignRedirectSeconds)*time.Second)
+		return tiered.NewTieredBackend(hotBackend, coldBackend, time.Duration(Config.tieredMigrateAfterHours)*time.Hour)
+	} else if Config.s3Bucket != "" {
+		return s3.NewS3Backend(Config.s3Bucket, Config.s3Region, Config.s3Endpoint, Config.s3ForcePathStyle, time.Duration(Config.s3PresignRedirectSeconds)*time.Second)
+	} else {
+		return localfs.NewLocalfsBackend(metaDir, Config.filesDir, Config.minFreeSpaceGB, Config.localfsDedup, Config.localfsSharded)
+	}
+}
+
 func main() {
 	flag.StringVar(&Config.bind, "bind", "127.0.0.1:8080",
 		"host to bind to (default: 127.0.0.1:8080)")
@@ -276,8 +455,12 @@ func main() {
 		"path relative to site base url where files are accessed directly")
 	flag.Int64Var(&Config.maxSize, "maxsize", 4*1024*1024*1024,
 		"maximum upload file size in bytes (default 4GB)")
+	flag.Int64Var(&Config.chunkSize, "chunksize", 0,
+		"split uploads from the web uploader into chunks of this many bytes, e.g. to stay below the body size limit of a proxy (default is 0, no chunks)")
 	flag.Uint64Var(&Config.maxExpiry, "maxexpiry", 0,
 		"maximum expiration time in seconds (default is 0, which is no expiry)")
+	flag.Uint64Var(&Config.stagingExpiry, "staging-expiry", 24*60*60,
+		"time in seconds that unfinished resumable uploads are kept (default 1 day, 0 keeps them until they are finished)")
 	flag.StringVar(&Config.certFile, "certfile", "",
 		"path to ssl certificate (for https)")
 	flag.StringVar(&Config.keyFile, "keyfile", "",
@@ -312,6 +495,12 @@ func main() {
 		"S3 bucket to use for files and metadata")
 	flag.BoolVar(&Config.s3ForcePathStyle, "s3-force-path-style", false,
 		"Force path-style addressing for S3 (e.g. https://s3.amazonaws.com/linx/example.txt)")
+	flag.BoolVar(&Config.memoryStorage, "memory-storage", false,
+		"Keep files in memory only, they are lost when linx-server stops")
+	flag.Int64Var(&Config.memoryMaxSize, "memory-max-size", 256*1024*1024,
+		"Maximum size of all files kept in memory in bytes, the least recently used files are dropped to make room (set 0 for no limit)")
+	flag.Uint64Var(&Config.s3PresignRedirectSeconds, "s3-presign-redirect-seconds", 0,
+		"Redirect downloads to presigned S3 URLs valid for this many seconds instead of sending the files through linx-server (default is 0, which means disabled)")
 	flag.BoolVar(&Config.anyoneCanDelete, "anyone-can-delete", false,
 		"Anyone has delete button on the file page")
 	flag.Uint64Var(&Config.accessKeyCookieExpiry, "access-cookie-expiry", 0,
@@ -322,12 +511,54 @@ func main() {
 		"How often to clean up expired files in minutes (default is 0, which means files will be cleaned up as they are accessed)")
 	flag.Var(&Config.forbiddenExtensions, "forbidden-extension",
 		"Restrict uploading files with extension (e.g. exe). This option can be used multiple times.")
+	flag.BoolVar(&Config.remoteUploads, "remote-uploads", false,
+		"Allow uploading files from a URL, which linx-server fetches")
+	flag.Uint64Var(&Config.remoteUploadTimeout, "remote-upload-timeout", 600,
+		"Time in seconds that fetching a file for a remote upload may take")
+	flag.IntVar(&Config.remoteUploadMaxRedirects, "remote-upload-max-redirects", 5,
+		"Maximum number of redirects followed for a remote upload")
+	flag.Var(&Config.remoteUploadAllow, "remote-upload-allow",
+		"Allow remote uploads from a network (e.g. 10.1.0.0/16) that would be denied otherwise, including private networks. This option can be used multiple times.")
+	flag.Var(&Config.remoteUploadDeny, "remote-upload-deny",
+		"Deny remote uploads from a network (e.g. 203.0.113.0/24) in addition to private networks. This option can be used multiple times.")
 	flag.Uint64Var(&Config.defaultExpiryCli, "default-expiry-cli", 0,
 		"Default expiry time in seconds for cli uploads (set 0 to use max expiry)")
 	flag.StringVar(&Config.pprofBind, "pprof-bind", "",
 		"Bind address for pprof (e.g. 127.0.0.1:6060)")
 	flag.Float64Var(&Config.minFreeSpaceGB, "min-free-space-gb", 0,
 		"Minimum free disk space in GB to maintain (default 0, disabled). Only applies to localfs backend.")
+	flag.Int64Var(&Config.quotaBytes, "quota-bytes", 0,
+		"Maximum total size of all stored files in bytes (default 0, disabled)")
+	flag.Int64Var(&Config.quotaFiles, "quota-files", 0,
+		"Maximum number of stored files (default 0, disabled)")
+	flag.StringVar(&Config.quotaEviction, "quota-eviction", quota.EvictExpiry,
+		"Which files to delete when the quota is reached: expiry (expiring soonest), lru (least recently downloaded), largest, or reject to refuse new uploads instead")
+	flag.Int64Var(&Config.quotaStagingBytes, "quota-staging-bytes", 0,
+		"Maximum total size of unfinished resumable uploads in bytes, they are never evicted (default 0, the same as quota-bytes)")
+	flag.Uint64Var(&Config.quotaResyncEveryMinutes, "quota-resync-every-minutes", 60,
+		"How often to recount the stored files for the quota in minutes, e.g. after linx-cleanup deleted some (set 0 to disable)")
+	flag.BoolVar(&Config.localfsDedup, "localfs-dedup", false,
+		"Store identical uploads only once and hard link them to each filename. Only applies to localfs backend.")
+	flag.BoolVar(&Config.localfsSharded, "localfs-sharded", false,
+		"Spread files over two levels of subdirectories (e.g. files/3f/a2/name). Existing files can be moved with linx-shard. Only applies to localfs backend.")
+	flag.BoolVar(&Config.tieredStorage, "tiered-storage", false,
+		"Keep new uploads in filespath and move them to the S3 bucket later (requires s3-bucket)")
+	flag.Uint64Var(&Config.tieredMigrateAfterHours, "tiered-migrate-after-hours", 0,
+		"Move files to the S3 bucket once they are older than this many hours (default is 0, which means files are only moved when local free space drops below min-free-space-gb)")
+	flag.Uint64Var(&Config.tieredMigrateEveryMinutes, "tiered-migrate-every-minutes", 10,
+		"How often to look for files to move to the S3 bucket in minutes")
+	flag.Var(&Config.mirrorPaths, "mirror-path",
+		"Also store every file in the files/ and meta/ subdirectories of this path and read from it if the main storage fails. This option can be used multiple times.")
+	flag.Uint64Var(&Config.mirrorRepairEveryMinutes, "mirror-repair-every-minutes", 60,
+		"How often to copy files that are missing from a mirror in minutes (set 0 to disable)")
+	flag.StringVar(&Config.encryptionKey, "encryption-key", "",
+		"Hex encoded 32 byte key to encrypt stored files and their delete/access keys with (e.g. generated with openssl rand -hex 32)")
+	flag.BoolVar(&Config.compressFiles, "compress-files", false,
+		"Store text files gzip compressed and send them compressed to clients that accept it")
+	flag.StringVar(&Config.sqliteMetadata, "sqlite-metadata", "",
+		"Path to a SQLite database to keep file metadata in instead of metapath or S3 object metadata")
+	flag.BoolVar(&Config.sqliteImport, "sqlite-import", false,
+		"On startup, import the metadata of files missing from the SQLite database from metapath or S3 object metadata")
 
 	iniflags.Parse()
 
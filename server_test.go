@@ -1,12 +1,17 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"os"
 	"path"
@@ -14,6 +19,9 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/labstack/echo/v4"
 )
 
 type RespOkJSON struct {
@@ -529,6 +537,64 @@ func TestPostExpiresJSONUpload(t *testing.T) {
 	}
 }
 
+func TestPostFieldsBeforeFileJSONUpload(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".txt"
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	exp, err := mw.CreateFormField("expires")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp.Write([]byte("60"))
+
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("File content"))
+
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson RespOkJSON
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	myExp, err := strconv.ParseInt(myjson.Expiry, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	curTime := time.Now().Unix()
+
+	if myExp < curTime || myExp > curTime+60 {
+		t.Fatalf("File expiry (%d) is not within 60 seconds of the current time (%d)", myExp, curTime)
+	}
+
+	if myjson.Size != "12" {
+		t.Fatalf("File size was not 12 but %s", myjson.Size)
+	}
+}
+
 func TestPostEmptyUpload(t *testing.T) {
 	mux := setup()
 	w := httptest.NewRecorder()
@@ -585,16 +651,212 @@ func TestPostTooLargeUpload(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	stored := storedFiles(t)
 	mux.ServeHTTP(w, req)
 
 	if w.Code != 400 {
 		t.Log(w.Body.String())
 		t.Fatalf("Status code is not 400, but %d", w.Code)
 	}
+	if len(storedFiles(t)) != len(stored) {
+		t.Fatal("Upload over the size limit was stored")
+	}
 
 	Config.maxSize = oldMaxSize
 }
 
+func TestPostTooLargeCollection(t *testing.T) {
+	mux := setup()
+	oldMaxSize := Config.maxSize
+	Config.maxSize = 5
+	defer func() { Config.maxSize = oldMaxSize }()
+	w := httptest.NewRecorder()
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for _, content := range []string{"small", "too large"} {
+		fw, err := mw.CreateFormFile("file", generateBarename()+".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Referer", Config.siteURL)
+
+	stored := storedFiles(t)
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+	if len(storedFiles(t)) != len(stored) {
+		t.Fatal("Files of the rejected collection were kept")
+	}
+}
+
+func TestPostTrailingAccessKey(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".txt"
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	req, err := http.NewRequest("POST", "/upload/", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+
+	stored := storedFiles(t)
+	done := make(chan struct{})
+	go func() {
+		mux.ServeHTTP(w, req)
+		close(done)
+	}()
+
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("File content"))
+	// starting the next part ends the file, which is then stored
+	fw, err = mw.CreateFormField(accessKeyParamName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var added []string
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if added = newFiles(stored, storedFiles(t)); len(added) == 1 {
+			if _, err = storageBackend.Head(context.Background(), added[0]); err == nil {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("File was not stored before the request ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	getW := httptest.NewRecorder()
+	getReq, err := http.NewRequest("GET", "/"+Config.selifPath+added[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(getW, getReq)
+	if getW.Code != 404 {
+		t.Fatalf("File was served with %d before its access key was applied", getW.Code)
+	}
+
+	fw.Write([]byte("secret"))
+	mw.Close()
+	pw.Close()
+	<-done
+
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson RespOkJSON
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := storageBackend.Head(context.Background(), myjson.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.AccessKey != "secret" {
+		t.Fatalf("Access key is %q instead of the one sent after the file", metadata.AccessKey)
+	}
+}
+
+func TestPostWithoutTrailingFields(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, err := mw.CreateFormFile("file", generateBarename()+".txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("File content"))
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+
+	// the metadata is only written once, with the file
+	base := storageBackend
+	storageBackend = failingMetadataBackend{StorageBackend: base, fails: func(key string, m backends.Metadata) bool {
+		return true
+	}}
+	mux.ServeHTTP(w, req)
+	storageBackend = base
+
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson RespOkJSON
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getW := httptest.NewRecorder()
+	getReq, err := http.NewRequest("GET", "/"+Config.selifPath+myjson.Filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(getW, getReq)
+	if getW.Code != 200 || getW.Body.String() != "File content" {
+		t.Fatalf("Uploaded file was served with %d", getW.Code)
+	}
+}
+
+// storedFiles lists the files in the storage backend
+func storedFiles(t *testing.T) []string {
+	files, err := storageBackend.(backends.MetaStorageBackend).List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// newFiles returns the files in after that are not in before
+func newFiles(before, after []string) []string {
+	known := map[string]bool{}
+	for _, f := range before {
+		known[f] = true
+	}
+	var added []string
+	for _, f := range after {
+		if !known[f] {
+			added = append(added, f)
+		}
+	}
+	return added
+}
+
 func TestPostEmptyJSONUpload(t *testing.T) {
 	mux := setup()
 	w := httptest.NewRecorder()
@@ -705,6 +967,7 @@ func TestPutTooLargeUpload(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	stored := storedFiles(t)
 	mux.ServeHTTP(w, req)
 
 	if w.Code != 500 {
@@ -715,6 +978,9 @@ func TestPutTooLargeUpload(t *testing.T) {
 	if !strings.Contains(w.Body.String(), "request body too large") {
 		t.Fatal("Response did not contain 'request body too large'")
 	}
+	if len(storedFiles(t)) != len(stored) {
+		t.Fatal("Upload over the size limit was stored")
+	}
 
 	Config.maxSize = oldMaxSize
 }
@@ -1025,3 +1291,950 @@ func TestPutAndGetCLI(t *testing.T) {
 	}
 
 }
+
+func TestGetConditionalAndRange(t *testing.T) {
+	var myjson RespOkJSON
+	mux := setup()
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/upload", strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	mux.ServeHTTP(w, req)
+
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/"+Config.selifPath+myjson.Filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(header, value)
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// the file changed since then, so it is sent in full
+	w = get("If-Modified-Since", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat))
+	if w.Code != 200 || w.Body.String() != "File content" {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	etag := get("Accept", "*/*").Header().Get("Etag")
+	w = get("If-None-Match", etag)
+	if w.Code != 304 {
+		t.Fatalf("Status code is not 304, but %d", w.Code)
+	}
+
+	w = get("Range", "bytes=5-11")
+	if w.Code != 206 || w.Body.String() != "content" {
+		t.Fatalf("Status code is not 206, but %d", w.Code)
+	}
+}
+
+func TestPutAndGetLastModified(t *testing.T) {
+	var myjson RespOkJSON
+	mux := setup()
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/upload", strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	mux.ServeHTTP(w, req)
+
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+Config.selifPath+myjson.Filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	lastModified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(lastModified) > time.Minute {
+		t.Fatalf("Last-Modified is not the upload time but %s", lastModified)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+Config.selifPath+myjson.Filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 304 {
+		t.Fatalf("Status code is not 304, but %d", w.Code)
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	mux := setup()
+
+	tusRequest := func(method, url string, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := tusRequest("POST", "/upload/tus/", "", map[string]string{
+		"Upload-Length":   "12",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("test.txt")),
+	})
+	if w.Code != 201 {
+		t.Fatalf("Status code is not 201, but %d", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadURL := location.Path
+
+	patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+	w = tusRequest("PATCH", uploadURL, "File ", patch)
+	if w.Code != 204 {
+		t.Fatalf("Status code is not 204, but %d", w.Code)
+	}
+
+	// a retry of the same chunk has the wrong offset
+	w = tusRequest("PATCH", uploadURL, "File ", patch)
+	if w.Code != 409 {
+		t.Fatalf("Status code is not 409, but %d", w.Code)
+	}
+
+	w = tusRequest("HEAD", uploadURL, "", nil)
+	if w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("Upload-Offset is not 5, but %s", w.Header().Get("Upload-Offset"))
+	}
+
+	patch["Upload-Offset"] = "5"
+	w = tusRequest("PATCH", uploadURL, "content", patch)
+	if w.Code != 204 {
+		t.Fatalf("Status code is not 204, but %d", w.Code)
+	}
+	filename := w.Header().Get("Linx-Filename")
+	if !strings.HasSuffix(filename, ".txt") {
+		t.Fatalf("Filename does not have the txt extension: %s", filename)
+	}
+
+	w = httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/"+Config.selifPath+filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Body.String() != "File content" {
+		t.Fatalf("File content is not the uploaded data: %q", w.Body.String())
+	}
+}
+
+func TestStagingLocksReleased(t *testing.T) {
+	mux := setup()
+
+	unlock, err := lockStagedUpload("locked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockStagedUpload("locked"); err != UploadLockedError {
+		t.Fatalf("Locking an upload twice returned %v", err)
+	}
+	unlock()
+
+	// requests for unknown uploads don't leave a lock behind
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("HEAD", "/upload/tus/"+newStagingID(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != 404 {
+			t.Fatalf("Status code is not 404, but %d", w.Code)
+		}
+	}
+
+	stagingLocks.Lock()
+	held := len(stagingLocks.held)
+	stagingLocks.Unlock()
+	if held != 0 {
+		t.Fatalf("%d upload locks were kept", held)
+	}
+}
+
+func TestPostChunkedJSONUpload(t *testing.T) {
+	mux := setup()
+
+	uuid := generateBarename()
+	sendChunk := func(index int, content, sha256sum string) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		mw.WriteField("dzuuid", uuid)
+		mw.WriteField("dzchunkindex", strconv.Itoa(index))
+		mw.WriteField("dztotalchunkcount", "2")
+		mw.WriteField("dztotalfilesize", "12")
+		if sha256sum != "" {
+			mw.WriteField("dzchunksha256", sha256sum)
+		}
+		fw, err := mw.CreateFormFile("file", "chunked.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+		mw.Close()
+
+		req, err := http.NewRequest("POST", "/upload/", &b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Referer", Config.siteURL)
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := sendChunk(0, "File ", "")
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	// a corrupted chunk is rejected
+	w = sendChunk(1, "c0ntent", "0ce5b8b4fb9b6a8e0c4c3c7f4e4e0d6a9e2d2d2fa2be1c6e3b1f6d3d0a7d46d4")
+	if w.Code != 400 {
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+
+	w = sendChunk(1, "content", "")
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson RespOkJSON
+	err := json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if myjson.Size != "12" {
+		t.Fatalf("File size was not 12 but %s", myjson.Size)
+	}
+	if myjson.Original_Name != "chunked.txt" {
+		t.Fatalf("Original name was not chunked.txt but %s", myjson.Original_Name)
+	}
+}
+
+func TestPostChunkedFileChecksum(t *testing.T) {
+	mux := setup()
+
+	sendFile := func(sha256sum string) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		mw.WriteField("dzuuid", generateBarename())
+		mw.WriteField("dzchunkindex", "0")
+		mw.WriteField("dztotalchunkcount", "1")
+		mw.WriteField("dztotalfilesize", "12")
+		mw.WriteField("dzfilesha256", sha256sum)
+		fw, err := mw.CreateFormFile("file", "chunked.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("File content"))
+		mw.Close()
+
+		req, err := http.NewRequest("POST", "/upload/", &b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Referer", Config.siteURL)
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	stored := storedFiles(t)
+	w := sendFile("0ce5b8b4fb9b6a8e0c4c3c7f4e4e0d6a9e2d2d2fa2be1c6e3b1f6d3d0a7d46d4")
+	if w.Code != 400 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+	if added := newFiles(stored, storedFiles(t)); len(added) != 0 {
+		t.Fatalf("File that does not match its checksum was kept: %v", added)
+	}
+
+	w = sendFile("F0CA7EF61AED3763F9BEC72E14379549179C5D31CC25F23A6E62FCDC43F3374C")
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+}
+
+func TestRemoteUpload(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("File content"))
+	}))
+	defer remote.Close()
+
+	Config.remoteUploads = true
+	defer func() {
+		Config.remoteUploads = false
+		Config.remoteUploadAllow = nil
+	}()
+
+	remoteUpload := func(mux *echo.Echo) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Add("url", remote.URL+"/remote.txt")
+
+		req, err := http.NewRequest("POST", "/upload/remote", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Referer", Config.siteURL)
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// the test server listens on loopback, which is denied by default
+	w := remoteUpload(setup())
+	if w.Code != 400 {
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+
+	Config.remoteUploadAllow = headerList{"127.0.0.0/8"}
+	w = remoteUpload(setup())
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson RespOkJSON
+	err := json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if myjson.Size != "12" {
+		t.Fatalf("File size was not 12 but %s", myjson.Size)
+	}
+	if myjson.Original_Name != "remote.txt" {
+		t.Fatalf("Original name was not remote.txt but %s", myjson.Original_Name)
+	}
+}
+
+func TestRemoteAddrAllowed(t *testing.T) {
+	oldAllowed, oldDenied := remoteAllowed, remoteDenied
+	remoteAllowed, remoteDenied = nil, nil
+	defer func() { remoteAllowed, remoteDenied = oldAllowed, oldDenied }()
+
+	for _, test := range []struct {
+		addr    string
+		allowed bool
+	}{
+		{"93.184.215.14", true},
+		{"2606:2800:21f::1", true},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		// IPv4-mapped
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:93.184.215.14", true},
+		// IPv4-compatible
+		{"::127.0.0.1", false},
+		{"::93.184.215.14", false},
+		// NAT64
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b:1::a00:1", false},
+		{"64:ff9b:0:0:1::1", true},
+		// Teredo, with the client address in the last 32 bits inverted
+		{"2001:0:4136:e378:8000:63bf:80ff:fffe", false},
+		{"2001:0:c0a8:101::1", false},
+		// 6to4
+		{"2002:7f00:1::1", false},
+		{"2002:c0a8:101::1", false},
+		{"2003:7f00:1::1", true},
+	} {
+		if remoteAddrAllowed(netip.MustParseAddr(test.addr)) != test.allowed {
+			t.Errorf("Fetching from %s allowed: %v", test.addr, !test.allowed)
+		}
+	}
+}
+
+func TestPostCollectionJSONUpload(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	mw.WriteField("collection", "Holiday")
+	for _, content := range []string{"File content", "More content"} {
+		fw, err := mw.CreateFormFile("file", generateBarename()+".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson struct {
+		RespOkJSON
+		Files []RespOkJSON
+	}
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if myjson.Original_Name != "Holiday" {
+		t.Fatalf("Collection name is not Holiday but %s", myjson.Original_Name)
+	}
+	if len(myjson.Files) != 2 {
+		t.Fatalf("Collection does not have 2 files but %d", len(myjson.Files))
+	}
+	for _, file := range myjson.Files {
+		if file.Delete_Key != myjson.Delete_Key {
+			t.Fatalf("File %s does not share the delete key of the collection", file.Filename)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+myjson.Filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), myjson.Files[1].Filename) {
+		t.Fatal("Collection page does not link its files")
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("DELETE", "/"+myjson.Filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Linx-Delete-Key", myjson.Delete_Key)
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	for _, file := range myjson.Files {
+		_, err = storageBackend.Head(context.Background(), file.Filename)
+		if err != backends.NotFoundErr {
+			t.Fatalf("File %s was not deleted with its collection", file.Filename)
+		}
+	}
+}
+
+// putTestFile uploads content with PUT and the given headers
+func putTestFile(t *testing.T, mux *echo.Echo, name, content string, headers map[string]string) RespOkJSON {
+	req, err := http.NewRequest("PUT", "/upload/"+name, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson RespOkJSON
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return myjson
+}
+
+// postTestCollection makes a collection of uploaded files
+func postTestCollection(mux *echo.Echo, files []RespOkJSON, form url.Values) *httptest.ResponseRecorder {
+	for _, file := range files {
+		form.Add("files", file.Filename)
+		form.Add("delete_keys", file.Delete_Key)
+	}
+	req, _ := http.NewRequest("POST", "/upload/collection", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestCollectionKeepsExpiry(t *testing.T) {
+	mux := setup()
+	ctx := context.Background()
+
+	files := []RespOkJSON{
+		putTestFile(t, mux, "soon.txt", "File content", map[string]string{"Linx-Expiry": "60"}),
+		putTestFile(t, mux, "later.txt", "More content", map[string]string{"Linx-Expiry": "3600"}),
+	}
+	w := postTestCollection(mux, files, url.Values{})
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson RespOkJSON
+	err := json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		metadata, err := storageBackend.Head(ctx, file.Filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strconv.FormatInt(metadata.Expiry.Unix(), 10) != file.Expiry {
+			t.Fatalf("Expiry of %s changed from %s to %d", file.Filename, file.Expiry, metadata.Expiry.Unix())
+		}
+		if metadata.DeleteKey != myjson.Delete_Key {
+			t.Fatalf("File %s does not share the delete key of the collection", file.Filename)
+		}
+	}
+	if myjson.Expiry != files[1].Expiry {
+		t.Fatalf("Collection expires at %s instead of with its last file at %s", myjson.Expiry, files[1].Expiry)
+	}
+}
+
+// failingMetadataBackend fails to store the metadata it is told to
+type failingMetadataBackend struct {
+	backends.StorageBackend
+	fails func(key string, m backends.Metadata) bool
+}
+
+func (b failingMetadataBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	if b.fails(key, m) {
+		return backends.BadMetadata
+	}
+	return b.StorageBackend.PutMetadata(ctx, key, m)
+}
+
+func TestCollectionRollback(t *testing.T) {
+	mux := setup()
+	ctx := context.Background()
+
+	files := []RespOkJSON{
+		putTestFile(t, mux, "a.txt", "File content", nil),
+		putTestFile(t, mux, "b.txt", "More content", nil),
+	}
+	stored := storedFiles(t)
+
+	base := storageBackend
+	storageBackend = failingMetadataBackend{StorageBackend: base, fails: func(key string, m backends.Metadata) bool {
+		return key == files[1].Filename
+	}}
+	w := postTestCollection(mux, files, url.Values{"expires": {"60"}})
+	storageBackend = base
+
+	if w.Code != 500 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 500, but %d", w.Code)
+	}
+	if added := newFiles(stored, storedFiles(t)); len(added) != 0 {
+		t.Fatalf("Collection of the failed request was kept: %v", added)
+	}
+	for _, file := range files {
+		metadata, err := storageBackend.Head(ctx, file.Filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.DeleteKey != file.Delete_Key || strconv.FormatInt(metadata.Expiry.Unix(), 10) != file.Expiry {
+			t.Fatalf("File %s was not changed back", file.Filename)
+		}
+	}
+
+	// files uploaded together are deleted if their collection can't be made
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for _, content := range []string{"File content", "More content"} {
+		fw, err := mw.CreateFormFile("file", generateBarename()+".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.WriteField("expires", "60")
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Referer", Config.siteURL)
+
+	storageBackend = failingMetadataBackend{StorageBackend: base, fails: func(key string, m backends.Metadata) bool {
+		return isCollection(m)
+	}}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	storageBackend = base
+
+	if w.Code != 500 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 500, but %d", w.Code)
+	}
+	if added := newFiles(stored, storedFiles(t)); len(added) != 0 {
+		t.Fatalf("Files of the failed collection were kept: %v", added)
+	}
+}
+
+func TestCollectionNeedsDeleteKeys(t *testing.T) {
+	mux := setup()
+	ctx := context.Background()
+	Config.anyoneCanDelete = true
+	defer func() { Config.anyoneCanDelete = false }()
+
+	file := putTestFile(t, mux, "a.txt", "File content", map[string]string{"Linx-Access-Key": "secret"})
+
+	for form, code := range map[string]int{
+		"files=" + file.Filename + "&access_key=":                   400,
+		"files=" + file.Filename + "&delete_keys=wrong&access_key=": 401,
+		"files=" + file.Filename + "&delete_keys=&access_key=":      401,
+	} {
+		req, _ := http.NewRequest("POST", "/upload/collection", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Referer", Config.siteURL)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != code {
+			t.Fatalf("Status code of %s is not %d, but %d", form, code, w.Code)
+		}
+	}
+
+	metadata, err := storageBackend.Head(ctx, file.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.DeleteKey != file.Delete_Key || metadata.AccessKey != "secret" {
+		t.Fatal("File was changed without its delete key")
+	}
+}
+
+func TestCollectionHidesLockedFiles(t *testing.T) {
+	mux := setup()
+
+	files := []RespOkJSON{
+		putTestFile(t, mux, "public.txt", "File content", nil),
+		putTestFile(t, mux, "private.txt", "More content", map[string]string{"Linx-Access-Key": "secret"}),
+	}
+	w := postTestCollection(mux, files, url.Values{})
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	var collection RespOkJSON
+	err := json.Unmarshal([]byte(w.Body.String()), &collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "secret"} {
+		req, err := http.NewRequest("GET", "/"+collection.Filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		if key != "" {
+			req.Header.Set("Linx-Access-Key", key)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("Status code is not 200, but %d", w.Code)
+		}
+
+		var myjson struct {
+			Files []map[string]string
+		}
+		err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(myjson.Files) != 2 {
+			t.Fatalf("Collection does not list 2 files but %d", len(myjson.Files))
+		}
+		if myjson.Files[0]["original_name"] != "public.txt" {
+			t.Fatalf("Unprotected file is listed as %v", myjson.Files[0])
+		}
+		_, shown := myjson.Files[1]["original_name"]
+		if shown != (key == "secret") || (myjson.Files[1]["size"] != "") != shown || (myjson.Files[1]["mimetype"] != "") != shown {
+			t.Fatalf("Protected file is listed as %v with key %q", myjson.Files[1], key)
+		}
+	}
+}
+
+func TestZipFiles(t *testing.T) {
+	mux := setup()
+
+	var filenames []string
+	for i, content := range []string{"File content", "More content"} {
+		req, err := http.NewRequest("PUT", "/upload/same.txt", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		if i == 1 {
+			req.Header.Set("Linx-Access-Key", "secret")
+		}
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		var myjson RespOkJSON
+		err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, myjson.Filename)
+	}
+
+	req, err := http.NewRequest("GET", "/zip?files="+strings.Join(filenames, ","), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 401 {
+		t.Fatalf("Status code is not 401, but %d", w.Code)
+	}
+
+	req.Header.Set("Linx-Access-Key", "secret")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"same.txt": "File content", "same (2).txt": "More content"}
+	if len(zr.File) != len(expected) {
+		t.Fatalf("Archive does not have %d files but %d", len(expected), len(zr.File))
+	}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected[f.Name] {
+			t.Fatalf("File %s has content '%s'", f.Name, content)
+		}
+	}
+}
+
+func TestZipHotlink(t *testing.T) {
+	mux := setup()
+
+	files := []RespOkJSON{
+		putTestFile(t, mux, "a.txt", "File content", nil),
+		putTestFile(t, mux, "b.txt", "More content", nil),
+	}
+	w := postTestCollection(mux, files, url.Values{})
+	var collection RespOkJSON
+	err := json.Unmarshal([]byte(w.Body.String()), &collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		url      string
+		location string
+	}{
+		{"/" + collection.Filename + "/zip", "/" + collection.Filename},
+		{"/zip?files=" + files[0].Filename, "/" + files[0].Filename},
+		{"/zip?files=" + files[0].Filename + "," + files[1].Filename, "/"},
+	} {
+		for referer, code := range map[string]int{
+			"":                          200,
+			Config.siteURL:              200,
+			"http://example.com/a.html": 303,
+		} {
+			req, err := http.NewRequest("GET", test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Referer", referer)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != code {
+				t.Fatalf("Status code of %s with referer %q is not %d, but %d", test.url, referer, code, w.Code)
+			}
+			if code == 303 && w.Header().Get("Location") != test.location {
+				t.Fatalf("%s redirects to %s instead of %s", test.url, w.Header().Get("Location"), test.location)
+			}
+		}
+	}
+}
+
+func TestZipStoresCompressedFiles(t *testing.T) {
+	mux := setup()
+
+	png, err := base64.StdEncoding.DecodeString("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []RespOkJSON{
+		putTestFile(t, mux, "image.png", string(png), nil),
+		putTestFile(t, mux, "text.txt", "File content", nil),
+	}
+
+	req, err := http.NewRequest("GET", "/zip?files="+files[0].Filename+","+files[1].Filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]uint16{"image.png": zip.Store, "text.txt": zip.Deflate}
+	for _, f := range zr.File {
+		if f.Method != expected[f.Name] {
+			t.Fatalf("%s is stored with method %d instead of %d", f.Name, f.Method, expected[f.Name])
+		}
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	Config.memoryStorage = true
+	Config.memoryMaxSize = 20
+	defer func() {
+		Config.memoryStorage = false
+		Config.memoryMaxSize = 0
+	}()
+	mux := setup()
+
+	upload := func(content string) RespOkJSON {
+		var myjson RespOkJSON
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/upload", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		mux.ServeHTTP(w, req)
+
+		err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return myjson
+	}
+	get := func(filename string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/"+Config.selifPath+filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	first := upload("First file")
+	if w := get(first.Filename); w.Code != 200 || w.Body.String() != "First file" {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	if _, err := os.Stat(path.Join(Config.filesDir, first.Filename)); err == nil {
+		t.Fatal("File was written to the files directory")
+	}
+
+	// both files don't fit, so the older one is evicted
+	second := upload("Second file")
+	if w := get(first.Filename); w.Code != 404 {
+		t.Fatalf("Evicted file returned %d instead of 404", w.Code)
+	}
+	if w := get(second.Filename); w.Code != 200 || w.Body.String() != "Second file" {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/upload", strings.NewReader("More than the whole memory"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatalf("Upload larger than the memory returned %d instead of 400", w.Code)
+	}
+}
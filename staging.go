@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/dchest/uniuri"
+)
+
+// Partial uploads are staged in the storage backend itself, so they survive
+// restarts and go through the configured encryption. Every chunk is stored
+// as its own file and a small state file records the upload. Generated
+// filenames never contain a "-" before the extension, so staged files can't
+// collide with uploads. Abandoned uploads expire like any other file. Staged
+// files have a quota of their own and are never evicted, the finished upload
+// counts towards the regular quota.
+const stagingPrefix = backends.StagingPrefix
+
+// maxStagingStateSize limits how much of a state file is read
+const maxStagingStateSize = 1 << 20
+
+var UploadLockedError = errors.New("upload is in use by another request")
+var ChecksumMismatchError = errors.New("checksum mismatch")
+
+// stagedUpload is the state of an upload that arrives in several requests
+type stagedUpload struct {
+	ID        string        `json:"id"`
+	Length    int64         `json:"length"`
+	Chunks    []int64       `json:"chunks"` // sizes of the stored chunks, in order
+	Filename  string        `json:"filename"`
+	Expiry    time.Duration `json:"expiry"`
+	DeleteKey string        `json:"delete_key,omitempty"`
+	AccessKey string        `json:"access_key,omitempty"`
+	Expires   int64         `json:"expires"`
+
+	// set once the upload is complete
+	Result          string `json:"result,omitempty"`
+	ResultDeleteKey string `json:"result_delete_key,omitempty"`
+}
+
+// stagingLocks holds the ids of the uploads a request is working on
+var stagingLocks = struct {
+	sync.Mutex
+	held map[string]bool
+}{held: make(map[string]bool)}
+
+func isStagingName(filename string) bool {
+	return strings.HasPrefix(filename, stagingPrefix)
+}
+
+func stagingStateKey(id string) string {
+	return stagingPrefix + id
+}
+
+func stagingChunkKey(id string, i int) string {
+	return stagingPrefix + id + "-" + strconv.Itoa(i)
+}
+
+func newStagingID() string {
+	return uniuri.NewLenChars(32, []byte("abcdefghijklmnopqrstuvwxyz0123456789"))
+}
+
+func newStagedUpload(ctx context.Context, id string, upReq UploadRequest) (*stagedUpload, error) {
+	u := &stagedUpload{
+		ID:        id,
+		Length:    upReq.size,
+		Filename:  upReq.filename,
+		Expiry:    upReq.expiry,
+		DeleteKey: upReq.deleteKey,
+		AccessKey: upReq.accessKey,
+		Expires:   expiryTime(time.Duration(Config.stagingExpiry) * time.Second).Unix(),
+	}
+	return u, u.save(ctx)
+}
+
+func loadStagedUpload(ctx context.Context, id string) (*stagedUpload, error) {
+	metadata, r, err := storageBackend.Get(ctx, stagingStateKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if expiry.IsTsExpired(metadata.Expiry) {
+		u := &stagedUpload{ID: id}
+		u.remove(ctx)
+		return nil, backends.NotFoundErr
+	}
+
+	u := &stagedUpload{}
+	err = json.NewDecoder(io.LimitReader(r, maxStagingStateSize)).Decode(u)
+	if err != nil {
+		return nil, backends.BadMetadata
+	}
+	return u, nil
+}
+
+// lockStagedUpload makes sure only one request works on an upload at a time
+func lockStagedUpload(id string) (unlock func(), err error) {
+	stagingLocks.Lock()
+	defer stagingLocks.Unlock()
+
+	if stagingLocks.held[id] {
+		return nil, UploadLockedError
+	}
+	stagingLocks.held[id] = true
+
+	return func() {
+		stagingLocks.Lock()
+		delete(stagingLocks.held, id)
+		stagingLocks.Unlock()
+	}, nil
+}
+
+func (u *stagedUpload) save(ctx context.Context) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = storageBackend.Put(ctx, stagingStateKey(u.ID), "", bytes.NewReader(data), u.expires(), uniuri.NewLen(30), "")
+	return err
+}
+
+func (u *stagedUpload) expires() time.Time {
+	return time.Unix(u.Expires, 0)
+}
+
+func (u *stagedUpload) offset() (offset int64) {
+	for _, size := range u.Chunks {
+		offset += size
+	}
+	return
+}
+
+func (u *stagedUpload) complete() bool {
+	return u.offset() == u.Length
+}
+
+// appendChunk stores the data of r as the next chunk, without going past
+// the length of the upload. If sha256sum is set, the chunk is only kept if
+// it matches.
+func (u *stagedUpload) appendChunk(ctx context.Context, r io.Reader, sha256sum string) (int64, error) {
+	ctx = context.WithoutCancel(ctx)
+	src := &limitReader{r: r, n: u.Length - u.offset()}
+	key := stagingChunkKey(u.ID, len(u.Chunks))
+	metadata, err := storageBackend.Put(ctx, key, "", src, u.expires(), uniuri.NewLen(30), "")
+	if src.exceeded || errors.Is(err, memory.FileTooLargeError) {
+		storageBackend.Delete(ctx, key)
+		return 0, FileTooLargeError
+	} else if errors.Is(err, backends.FileEmptyError) {
+		return 0, nil
+	} else if err != nil {
+		storageBackend.Delete(ctx, key)
+		return 0, err
+	}
+	if sha256sum != "" && !strings.EqualFold(sha256sum, metadata.Sha256sum) {
+		storageBackend.Delete(ctx, key)
+		return 0, ChecksumMismatchError
+	}
+
+	u.Chunks = append(u.Chunks, metadata.Size)
+	err = u.save(ctx)
+	if err != nil {
+		u.Chunks = u.Chunks[:len(u.Chunks)-1]
+		storageBackend.Delete(ctx, key)
+		return 0, err
+	}
+	return metadata.Size, nil
+}
+
+// finish turns the staged chunks into a regular upload, making sure the
+// stored file is exactly the staged data and, if sha256sum is set, the file
+// the client sent. The state is kept until it expires, so clients can still
+// look up the result.
+func (u *stagedUpload) finish(ctx context.Context, sha256sum string) (upload Upload, err error) {
+	src := &stagedReader{ctx: ctx, upload: u, hash: sha256.New()}
+	defer src.Close()
+
+	upload, err = processUpload(UploadRequest{
+		src:       src,
+		size:      u.Length,
+		filename:  u.Filename,
+		expiry:    u.Expiry,
+		deleteKey: u.DeleteKey,
+		accessKey: u.AccessKey,
+		ctx:       ctx,
+	})
+	if err != nil {
+		return
+	}
+	if upload.Metadata.Size != u.Length || upload.Metadata.Sha256sum != hex.EncodeToString(src.hash.Sum(nil)) ||
+		(sha256sum != "" && !strings.EqualFold(sha256sum, upload.Metadata.Sha256sum)) {
+		storageBackend.Delete(ctx, upload.Filename)
+		return upload, ChecksumMismatchError
+	}
+
+	u.removeChunks(ctx)
+	u.Chunks = nil
+	u.Result = upload.Filename
+	u.ResultDeleteKey = upload.Metadata.DeleteKey
+	return upload, u.save(ctx)
+}
+
+func (u *stagedUpload) removeChunks(ctx context.Context) {
+	for i := range u.Chunks {
+		storageBackend.Delete(ctx, stagingChunkKey(u.ID, i))
+	}
+}
+
+func (u *stagedUpload) remove(ctx context.Context) {
+	u.removeChunks(ctx)
+	storageBackend.Delete(ctx, stagingStateKey(u.ID))
+}
+
+// stagedReader reads the chunks of an upload one after another
+type stagedReader struct {
+	ctx    context.Context
+	upload *stagedUpload
+	next   int
+	r      io.ReadCloser
+	hash   hash.Hash
+}
+
+func (s *stagedReader) Read(p []byte) (int, error) {
+	for {
+		if s.r == nil {
+			if s.next == len(s.upload.Chunks) {
+				return 0, io.EOF
+			}
+			_, r, err := storageBackend.Get(s.ctx, stagingChunkKey(s.upload.ID, s.next))
+			if err != nil {
+				return 0, err
+			}
+			s.r = r
+			s.next++
+		}
+
+		n, err := s.r.Read(p)
+		s.hash.Write(p[:n])
+		if err == io.EOF {
+			s.r.Close()
+			s.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *stagedReader) Close() error {
+	if s.r == nil {
+		return nil
+	}
+	return s.r.Close()
+}
+
+// partialReader ends the stream cleanly at the first read error
+type partialReader struct {
+	r   io.Reader
+	err error
+}
+
+func (p *partialReader) Read(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, io.EOF
+	}
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+		err = io.EOF
+	}
+	return n, err
+}
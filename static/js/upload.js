@@ -4,6 +4,16 @@ Dropzone.options.dropzone = {
     init: function () {
         var dzone = document.getElementById("dzone");
         dzone.style.display = "block";
+
+        var chunkSize = parseInt(this.element.getAttribute("data-chunksize"), 10);
+        var uploadFiles = this.uploadFiles;
+        this.uploadFiles = function (files) {
+            if (chunkSize > 0 && files.length === 1 && files[0].size > chunkSize) {
+                uploadChunks(this, files[0], chunkSize);
+            } else {
+                uploadFiles.call(this, files);
+            }
+        };
     },
     addedfile: function (file) {
         var upload = document.createElement("div");
@@ -85,6 +95,13 @@ Dropzone.options.dropzone = {
         file.fileActions.removeChild(file.cancelActionElement);
         file.cancelActionElement = deleteAction;
         file.fileActions.appendChild(deleteAction);
+
+        if (!file.collection) {
+            finishedUploads.push(resp);
+            if (finishedUploads.length > 1) {
+                document.getElementById("collection").style.display = "flex";
+            }
+        }
     },
     canceled: function (file) {
         this.options.error(file);
@@ -120,6 +137,254 @@ Dropzone.options.dropzone = {
     maxFiles: 1
 };
 
+// Sends a large file in chunks, one after another, with the same fields as
+// Dropzone 5's chunking, which the bundled Dropzone 4 doesn't have. Failed
+// chunks are retried a few times. The whole file is hashed along the way,
+// so the server can make sure it stored exactly the file that was picked.
+function uploadChunks(dz, file, chunkSize) {
+    var uuid = Array.from(crypto.getRandomValues(new Uint8Array(16)), toHex).join("");
+    var count = Math.ceil(file.size / chunkSize);
+    var retries = 0;
+    var fileHash = new Sha256();
+    var hashedChunks = 0;
+    var fileSum = "";
+
+    // finished and failed end the upload with the events Dropzone emits for
+    // the uploads it sends itself
+    var finished = function (response, e) {
+        file.status = Dropzone.SUCCESS;
+        dz.emit("success", file, response, e);
+        dz.emit("complete", file);
+        if (dz.options.autoProcessQueue) {
+            dz.processQueue();
+        }
+    };
+    var failed = function (message, xhr) {
+        file.status = Dropzone.ERROR;
+        dz.emit("error", file, message, xhr);
+        dz.emit("complete", file);
+        if (dz.options.autoProcessQueue) {
+            dz.processQueue();
+        }
+    };
+
+    var sendChunk = function (index) {
+        var start = index * chunkSize;
+        var chunk = file.slice(start, Math.min(start + chunkSize, file.size));
+
+        readChunk(chunk, function (data, sha256sum) {
+            if (file.status === Dropzone.CANCELED) {
+                return;
+            }
+
+            // retried chunks were already hashed
+            if (fileHash && index === hashedChunks) {
+                if (data) {
+                    fileHash.update(data);
+                    hashedChunks++;
+                } else {
+                    fileHash = null;
+                }
+                if (hashedChunks === count) {
+                    fileSum = fileHash.hex();
+                }
+            }
+
+            var xhr = new XMLHttpRequest();
+            file.xhr = xhr;
+            xhr.open("POST", dz.options.url, true);
+            xhr.setRequestHeader("X-Requested-With", "XMLHttpRequest");
+            for (var name in dz.options.headers) {
+                xhr.setRequestHeader(name, dz.options.headers[name]);
+            }
+
+            var formData = new FormData();
+            formData.append("dzuuid", uuid);
+            formData.append("dzchunkindex", index);
+            formData.append("dztotalchunkcount", count);
+            formData.append("dztotalfilesize", file.size);
+            formData.append("dzchunkbyteoffset", start);
+            if (sha256sum) {
+                formData.append("dzchunksha256", sha256sum);
+            }
+            if (fileSum) {
+                formData.append("dzfilesha256", fileSum);
+            }
+            dz.emit("sending", file, xhr, formData);
+            var inputs = dz.element.querySelectorAll("input[name]");
+            for (var i = 0; i < inputs.length; i++) {
+                if (inputs[i].type !== "file" && inputs[i].type !== "submit") {
+                    formData.append(inputs[i].name, inputs[i].value);
+                }
+            }
+            formData.append("file", chunk, file.name);
+
+            xhr.upload.onprogress = function (e) {
+                var bytesSent = start + e.loaded;
+                file.upload = { progress: 100 * bytesSent / file.size, total: file.size, bytesSent: bytesSent };
+                dz.emit("uploadprogress", file, file.upload.progress, bytesSent);
+            };
+
+            var retry = function (response) {
+                if (file.status === Dropzone.CANCELED) {
+                    return;
+                }
+                // a chunk the server rejected would only be rejected again
+                if ((xhr.status === 0 || xhr.status >= 500) && retries < 3) {
+                    retries++;
+                    setTimeout(function () { sendChunk(index); }, 1000 * retries);
+                    return;
+                }
+                failed(response || "Server responded with " + xhr.status, xhr);
+            };
+
+            xhr.onload = function (e) {
+                var response = xhr.responseText;
+                if ((xhr.getResponseHeader("content-type") || "").indexOf("application/json") !== -1) {
+                    try {
+                        response = JSON.parse(response);
+                    } catch (_) {
+                        response = "Invalid JSON response from server.";
+                    }
+                }
+
+                if (xhr.status < 200 || xhr.status >= 300) {
+                    retry(response);
+                } else if (index < count - 1) {
+                    retries = 0;
+                    sendChunk(index + 1);
+                } else if (fileSum && response.sha256sum !== fileSum) {
+                    // the server only checks the sum when it assembles the
+                    // file, not when it answers a retry of the last chunk
+                    var del = new XMLHttpRequest();
+                    del.open("DELETE", response.url, true);
+                    del.setRequestHeader("Linx-Delete-Key", response.delete_key);
+                    del.send();
+                    failed("Uploaded file does not match the selected file", xhr);
+                } else {
+                    finished(response, e);
+                }
+            };
+            xhr.onerror = function () {
+                retry(null);
+            };
+
+            xhr.send(formData);
+        });
+    };
+
+    sendChunk(0);
+}
+
+// readChunk passes the data of a chunk and its sha256sum to callback. The
+// data is null where the browser can't read it and the sum is empty where it
+// can't compute it.
+function readChunk(chunk, callback) {
+    if (!chunk.arrayBuffer) {
+        callback(null, "");
+        return;
+    }
+
+    chunk.arrayBuffer().then(function (buffer) {
+        var data = new Uint8Array(buffer);
+        if (!window.crypto || !window.crypto.subtle) {
+            callback(data, "");
+            return;
+        }
+        crypto.subtle.digest("SHA-256", buffer).then(function (digest) {
+            callback(data, Array.from(new Uint8Array(digest), toHex).join(""));
+        }, function () {
+            callback(data, "");
+        });
+    }, function () {
+        callback(null, "");
+    });
+}
+
+// Sha256 hashes data that arrives in pieces, which the browser's crypto api
+// can't do
+function Sha256() {
+    this.h = new Uint32Array([0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19]);
+    this.block = new Uint8Array(64);
+    this.blockLength = 0;
+    this.length = 0;
+    this.w = new Uint32Array(64);
+}
+
+Sha256.k = new Uint32Array([
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+]);
+
+Sha256.prototype.update = function (data) {
+    this.length += data.length;
+    for (var i = 0; i < data.length; ) {
+        var n = Math.min(64 - this.blockLength, data.length - i);
+        this.block.set(data.subarray(i, i + n), this.blockLength);
+        this.blockLength += n;
+        i += n;
+        if (this.blockLength === 64) {
+            this.compress();
+            this.blockLength = 0;
+        }
+    }
+};
+
+Sha256.prototype.compress = function () {
+    var w = this.w, k = Sha256.k, h = this.h, b = this.block;
+    for (var i = 0; i < 16; i++) {
+        w[i] = (b[4 * i] << 24) | (b[4 * i + 1] << 16) | (b[4 * i + 2] << 8) | b[4 * i + 3];
+    }
+    for (i = 16; i < 64; i++) {
+        var x = w[i - 15], y = w[i - 2];
+        var s0 = ((x >>> 7) | (x << 25)) ^ ((x >>> 18) | (x << 14)) ^ (x >>> 3);
+        var s1 = ((y >>> 17) | (y << 15)) ^ ((y >>> 19) | (y << 13)) ^ (y >>> 10);
+        w[i] = w[i - 16] + s0 + w[i - 7] + s1;
+    }
+
+    var a = h[0], c = h[2], d = h[3], e = h[4], f = h[5], g = h[6], hh = h[7], bb = h[1];
+    for (i = 0; i < 64; i++) {
+        var S1 = ((e >>> 6) | (e << 26)) ^ ((e >>> 11) | (e << 21)) ^ ((e >>> 25) | (e << 7));
+        var t1 = (hh + S1 + ((e & f) ^ (~e & g)) + k[i] + w[i]) | 0;
+        var S0 = ((a >>> 2) | (a << 30)) ^ ((a >>> 13) | (a << 19)) ^ ((a >>> 22) | (a << 10));
+        var t2 = (S0 + ((a & bb) ^ (a & c) ^ (bb & c))) | 0;
+        hh = g; g = f; f = e; e = (d + t1) | 0;
+        d = c; c = bb; bb = a; a = (t1 + t2) | 0;
+    }
+    h[0] += a; h[1] += bb; h[2] += c; h[3] += d;
+    h[4] += e; h[5] += f; h[6] += g; h[7] += hh;
+};
+
+// hex returns the sum of the data so far, the hash can't be updated after
+Sha256.prototype.hex = function () {
+    var bits = this.length * 8;
+    var padding = new Uint8Array((this.blockLength < 56 ? 56 : 120) - this.blockLength + 8);
+    padding[0] = 0x80;
+    for (var i = 0; i < 8; i++) {
+        padding[padding.length - 1 - i] = (bits / Math.pow(2, 8 * i)) & 0xff;
+    }
+    this.update(padding);
+
+    var sum = new Uint8Array(32);
+    for (i = 0; i < 8; i++) {
+        sum[4 * i] = this.h[i] >>> 24;
+        sum[4 * i + 1] = this.h[i] >>> 16;
+        sum[4 * i + 2] = this.h[i] >>> 8;
+        sum[4 * i + 3] = this.h[i];
+    }
+    return Array.from(sum, toHex).join("");
+};
+
+function toHex(b) {
+    return ("0" + b.toString(16)).slice(-2);
+}
+
 document.onpaste = function (event) {
     var items = (event.clipboardData || event.originalEvent.clipboardData).items;
     for (index in items) {
@@ -130,6 +395,125 @@ document.onpaste = function (event) {
     }
 };
 
+var remoteButton = document.getElementById("remote_url_button");
+if (remoteButton) {
+    var remoteInput = document.getElementById("remote_url_input");
+
+    // Remote uploads are listed like the ones from Dropzone
+    var uploadRemote = function () {
+        if (!remoteInput.value) {
+            return;
+        }
+        var dz = Dropzone.forElement("#dropzone");
+        var options = Dropzone.options.dropzone;
+        var file = { name: remoteInput.value, status: Dropzone.UPLOADING };
+        options.addedfile.call(dz, file);
+        file.progressElement.innerHTML = "Fetching";
+
+        var xhr = new XMLHttpRequest();
+        file.xhr = xhr;
+        xhr.open("POST", remoteButton.getAttribute("data-url"), true);
+        xhr.setRequestHeader("Accept", "application/json");
+        xhr.setRequestHeader("X-Requested-With", "XMLHttpRequest");
+
+        var formData = new FormData();
+        formData.append("url", remoteInput.value);
+        formData.append("expires", document.getElementById("expires").value);
+        formData.append("access_key", document.getElementById("access_key_input").value);
+
+        xhr.onload = function () {
+            var response;
+            try {
+                response = JSON.parse(xhr.responseText);
+            } catch (_) {
+                response = xhr.responseText;
+            }
+
+            if (xhr.status === 200) {
+                file.status = Dropzone.SUCCESS;
+                options.success.call(dz, file, response);
+            } else {
+                file.status = Dropzone.ERROR;
+                options.error.call(dz, file, response);
+            }
+        };
+        xhr.onerror = function () {
+            file.status = Dropzone.ERROR;
+            options.error.call(dz, file, "Could not reach the server");
+        };
+        xhr.onabort = function () {
+            file.status = Dropzone.CANCELED;
+            options.error.call(dz, file, "");
+        };
+
+        xhr.send(formData);
+        remoteInput.value = "";
+    };
+
+    remoteButton.addEventListener("click", uploadRemote);
+    remoteInput.addEventListener("keydown", function (event) {
+        if (event.key === "Enter") {
+            uploadRemote();
+        }
+    });
+}
+
+// Files uploaded one by one can be put in a collection afterwards, their
+// delete keys are replaced by the one of the collection
+var finishedUploads = [];
+document.getElementById("collection_button").addEventListener("click", function (event) {
+    var uploads = finishedUploads;
+    finishedUploads = [];
+    document.getElementById("collection").style.display = "none";
+
+    var titleInput = document.getElementById("collection_title_input");
+    var dz = Dropzone.forElement("#dropzone");
+    var options = Dropzone.options.dropzone;
+    var file = { name: titleInput.value || "Collection", status: Dropzone.UPLOADING, collection: true };
+    options.addedfile.call(dz, file);
+
+    var xhr = new XMLHttpRequest();
+    file.xhr = xhr;
+    xhr.open("POST", event.target.getAttribute("data-url"), true);
+    xhr.setRequestHeader("Accept", "application/json");
+    xhr.setRequestHeader("X-Requested-With", "XMLHttpRequest");
+
+    var formData = new FormData();
+    for (var i = 0; i < uploads.length; i++) {
+        formData.append("files", uploads[i].filename);
+        formData.append("delete_keys", uploads[i].delete_key);
+    }
+    formData.append("collection", titleInput.value);
+    formData.append("expires", document.getElementById("expires").value);
+    formData.append("access_key", document.getElementById("access_key_input").value);
+
+    xhr.onload = function () {
+        var response;
+        try {
+            response = JSON.parse(xhr.responseText);
+        } catch (_) {
+            response = xhr.responseText;
+        }
+
+        if (xhr.status === 200) {
+            for (var i = 0; i < uploads.length; i++) {
+                uploads[i].delete_key = response.delete_key;
+            }
+            file.status = Dropzone.SUCCESS;
+            options.success.call(dz, file, response);
+        } else {
+            file.status = Dropzone.ERROR;
+            options.error.call(dz, file, response);
+        }
+    };
+    xhr.onerror = function () {
+        file.status = Dropzone.ERROR;
+        options.error.call(dz, file, "Could not reach the server");
+    };
+
+    xhr.send(formData);
+});
+
 document.getElementById("access_key_checkbox").onchange = function (event) {
     if (event.target.checked) {
         document.getElementById("access_key_input").style.display = "inline-block";
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/labstack/echo/v4"
+)
+
+// Resumable uploads following the tus protocol, see https://tus.io/protocols/resumable-upload
+
+const tusVersion = "1.0.0"
+const tusExtensions = "creation,creation-with-upload,termination,expiration"
+const tusContentType = "application/offset+octet-stream"
+
+var tusIDRe = regexp.MustCompile(`^[a-z0-9]{32}$`)
+
+func tusHeaders(c echo.Context) {
+	h := c.Response().Header()
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Cache-Control", "no-store")
+}
+
+// tusCheckVersion rejects requests of clients that speak another version of
+// the protocol. Browsers can't send the header cross-site without a CORS
+// preflight, so it also guards against CSRF.
+func tusCheckVersion(c echo.Context) bool {
+	tusHeaders(c)
+	if c.Request().Header.Get("Tus-Resumable") != tusVersion {
+		c.Response().Header().Set("Tus-Version", tusVersion)
+		return false
+	}
+	return true
+}
+
+func tusOptionsHandler(c echo.Context) error {
+	h := c.Response().Header()
+	tusHeaders(c)
+	h.Set("Tus-Version", tusVersion)
+	h.Set("Tus-Extension", tusExtensions)
+	h.Set("Tus-Max-Size", strconv.FormatInt(Config.maxSize, 10))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// tusMetadata parses the Upload-Metadata header, a comma separated list of
+// keys and base64 encoded values
+func tusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func tusCreateHandler(c echo.Context) error {
+	r := c.Request()
+	if !tusCheckVersion(c) {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return c.String(http.StatusBadRequest, "Upload-Length is required")
+	} else if size == 0 {
+		return c.String(http.StatusBadRequest, backends.FileEmptyError.Error())
+	} else if size > Config.maxSize {
+		return c.String(http.StatusRequestEntityTooLarge, FileTooLargeError.Error())
+	}
+
+	metadata, err := tusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid Upload-Metadata")
+	}
+
+	upReq := UploadRequest{size: size}
+	uploadHeaderProcess(r, &upReq)
+	upReq.filename = metadata["filename"]
+	if upReq.filename == "" {
+		upReq.filename = metadata["name"]
+	}
+	if len(upReq.filename) > 255 {
+		return c.String(http.StatusBadRequest, "filename too large")
+	}
+	// fail early instead of after the whole file was sent
+	if _, extension := barePlusExt(upReq.filename); extension != "" && forbiddenExtension(extension) {
+		return c.String(http.StatusBadRequest, "forbidden file extension")
+	}
+	if expires, ok := metadata["expires"]; ok {
+		cli := cliUserAgentRe.MatchString(r.Header.Get("User-Agent"))
+		upReq.expiry = parseExpiry(expires, cli)
+	}
+	if accessKey, ok := metadata[accessKeyParamName]; ok {
+		upReq.accessKey = accessKey
+	}
+
+	upload, err := newStagedUpload(r.Context(), newStagingID(), upReq)
+	if err != nil {
+		return oopsHandler(c, RespPLAIN, "Could not create upload")
+	}
+
+	h := c.Response().Header()
+	h.Set("Location", getSiteURL(r)+"upload/tus/"+upload.ID)
+	tusExpiresHeader(c, upload)
+
+	if r.Header.Get("Content-Type") == tusContentType {
+		return tusAppend(c, upload, http.StatusCreated)
+	}
+	h.Set("Upload-Offset", "0")
+	return c.NoContent(http.StatusCreated)
+}
+
+// tusLoad looks up the upload of the request and locks it
+func tusLoad(c echo.Context) (upload *stagedUpload, unlock func(), err error) {
+	id := c.Param("id")
+	if !tusIDRe.MatchString(id) {
+		return nil, nil, echo.ErrNotFound
+	}
+
+	unlock, err = lockStagedUpload(id)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusLocked, err.Error())
+	}
+
+	upload, err = loadStagedUpload(c.Request().Context(), id)
+	if err != nil {
+		unlock()
+		if errors.Is(err, backends.NotFoundErr) {
+			return nil, nil, echo.ErrNotFound
+		}
+		return nil, nil, err
+	}
+	return upload, unlock, nil
+}
+
+func tusHeadHandler(c echo.Context) error {
+	if !tusCheckVersion(c) {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+	upload, unlock, err := tusLoad(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tusUploadHeaders(c, upload)
+	return c.NoContent(http.StatusOK)
+}
+
+func tusPatchHandler(c echo.Context) error {
+	r := c.Request()
+	if !tusCheckVersion(c) {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		return c.NoContent(http.StatusUnsupportedMediaType)
+	}
+
+	upload, unlock, err := tusLoad(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Upload-Offset is required")
+	}
+	if upload.Result != "" || offset != upload.offset() {
+		tusUploadHeaders(c, upload)
+		return c.NoContent(http.StatusConflict)
+	}
+
+	return tusAppend(c, upload, http.StatusNoContent)
+}
+
+// tusAppend stores the request body and completes the upload once all of it
+// has arrived
+func tusAppend(c echo.Context, upload *stagedUpload, status int) error {
+	r := c.Request()
+
+	// if the connection drops, the data received until then is kept so the
+	// client can resume from there
+	_, err := upload.appendChunk(r.Context(), &partialReader{r: r.Body}, "")
+	if errors.Is(err, FileTooLargeError) {
+		return c.String(http.StatusRequestEntityTooLarge, "Request body is larger than the rest of the upload")
+	} else if err != nil {
+		return oopsHandler(c, RespPLAIN, "Could not store upload")
+	}
+
+	if upload.complete() {
+		// finish even if the client goes away, it can still get the result
+		// with a HEAD request
+		_, err = upload.finish(context.WithoutCancel(r.Context()), "")
+		if err != nil {
+			upload.remove(context.WithoutCancel(r.Context()))
+			if errors.Is(err, FileTooLargeError) || errors.Is(err, backends.FileEmptyError) {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			return c.String(http.StatusInternalServerError, "Could not upload file: "+err.Error())
+		}
+	}
+
+	tusUploadHeaders(c, upload)
+	return c.NoContent(status)
+}
+
+// tusUploadHeaders describes the progress of an upload and, once it is
+// complete, where the file can be found
+func tusUploadHeaders(c echo.Context, upload *stagedUpload) {
+	h := c.Response().Header()
+	h.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	tusExpiresHeader(c, upload)
+	if upload.Result == "" {
+		h.Set("Upload-Offset", strconv.FormatInt(upload.offset(), 10))
+		return
+	}
+
+	siteURL := getSiteURL(c.Request())
+	h.Set("Upload-Offset", strconv.FormatInt(upload.Length, 10))
+	h.Set("Linx-Filename", upload.Result)
+	h.Set("Linx-Url", siteURL+upload.Result)
+	h.Set("Linx-Direct-Url", siteURL+Config.selifPath+upload.Result)
+	h.Set("Linx-Delete-Key", upload.ResultDeleteKey)
+}
+
+func tusExpiresHeader(c echo.Context, upload *stagedUpload) {
+	if upload.expires() != expiry.NeverExpire {
+		c.Response().Header().Set("Upload-Expires", upload.expires().UTC().Format(http.TimeFormat))
+	}
+}
+
+func tusDeleteHandler(c echo.Context) error {
+	if !tusCheckVersion(c) {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+	upload, unlock, err := tusLoad(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// only the staged data goes away, a completed file is deleted with its
+	// delete key as usual
+	upload.remove(c.Request().Context())
+	return c.NoContent(http.StatusNoContent)
+}
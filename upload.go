@@ -5,14 +5,18 @@ import (
 	"context"
 	"errors"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
 	"github.com/andreimarcu/linx-server/expiry"
 	"github.com/andreimarcu/linx-server/helpers"
 	"github.com/dchest/uniuri"
@@ -22,6 +26,10 @@ import (
 )
 
 var FileTooLargeError = errors.New("File too large.")
+
+// maxFieldSize limits the size of the form fields sent along with a file
+const maxFieldSize = 64 * 1024
+
 var fileBlacklist = map[string]bool{
 	"favicon.ico":     true,
 	"index.htm":       true,
@@ -39,9 +47,38 @@ type UploadRequest struct {
 	expiry    time.Duration // Seconds until expiry, 0 = never
 	deleteKey string        // Empty string if not defined
 	accessKey string        // Empty string if not defined
+	hold      bool          // Keep the file from being served until it is released
 	ctx       context.Context
 }
 
+// heldUploads holds the files of uploads that are stored, but whose
+// access key may still follow in the request. They aren't served until the
+// request is done with them.
+var heldUploads = struct {
+	sync.Mutex
+	held map[string]bool
+}{held: make(map[string]bool)}
+
+func holdUpload(filename string) {
+	heldUploads.Lock()
+	defer heldUploads.Unlock()
+	heldUploads.held[filename] = true
+}
+
+func releaseUploads(uploads []Upload) {
+	heldUploads.Lock()
+	defer heldUploads.Unlock()
+	for _, upload := range uploads {
+		delete(heldUploads.held, upload.Filename)
+	}
+}
+
+func isHeldUpload(filename string) bool {
+	heldUploads.Lock()
+	defer heldUploads.Unlock()
+	return heldUploads.held[filename]
+}
+
 // Metadata associated with a file as it would actually be stored
 type Upload struct {
 	Filename string // Final filename on disk
@@ -60,19 +97,25 @@ func uploadPostHandler(c echo.Context) error {
 
 	contentType := r.Header.Get("Content-Type")
 
+	var fields url.Values
+	var parts *multipart.Reader
 	if strings.HasPrefix(contentType, "multipart/form-data") {
-		file, headers, err := r.FormFile("file")
-		if r.MultipartForm != nil {
-			defer r.MultipartForm.RemoveAll()
+		// the file is streamed into storage as it arrives instead of being
+		// buffered by ParseMultipartForm first
+		var err error
+		parts, err = r.MultipartReader()
+		if err != nil {
+			return oopsHandler(c, RespHTML, "Could not upload file.")
 		}
+		fields = url.Values{}
+		file, err := nextFilePart(parts, fields)
 		if err != nil {
 			return oopsHandler(c, RespHTML, "Could not upload file.")
 		}
 		defer file.Close()
 
 		upReq.src = file
-		upReq.size = headers.Size
-		upReq.filename = headers.Filename
+		upReq.filename = file.FileName()
 	} else {
 		if r.PostFormValue("content") == "" {
 			return badRequestHandler(c, RespAUTO, "Empty file")
@@ -85,16 +128,96 @@ func uploadPostHandler(c echo.Context) error {
 		upReq.src = strings.NewReader(content)
 		upReq.size = int64(len(content))
 		upReq.filename = r.PostFormValue("filename") + "." + extension
+		fields = r.PostForm
 	}
 
 	cli := cliUserAgentRe.MatchString(r.Header.Get("User-Agent"))
-	upReq.expiry = parseExpiry(r.PostFormValue("expires"), cli)
-	upReq.accessKey = r.PostFormValue(accessKeyParamName)
+	upReq.expiry = parseExpiry(fields.Get("expires"), cli)
+	upReq.accessKey = fields.Get(accessKeyParamName)
+
+	if parts != nil && fields.Has("dzuuid") {
+		return uploadChunkHandler(c, upReq, fields)
+	}
+
+	// an access key sent after the files is only known once they are
+	// stored, until then they aren't served. A crash in between leaves them
+	// as the leading fields describe them, under names nobody was told.
+	upReq.hold = parts != nil && !fields.Has(accessKeyParamName)
 
 	upload, err := processUpload(upReq)
+	if err != nil || parts == nil {
+		return uploadResponse(c, upload, err)
+	}
+
+	// further files make the upload a collection, they share the delete key
+	// of the first one
+	uploads := []Upload{upload}
+	defer func() { releaseUploads(uploads) }()
+	upReq.deleteKey = upload.Metadata.DeleteKey
+	trailing := url.Values{}
+	for {
+		file, err := nextFilePart(parts, trailing)
+		if err == io.EOF {
+			break
+		} else if err == nil && len(uploads) == maxCollectionFiles {
+			err = TooManyFilesError
+		}
+		if err != nil {
+			deleteUploads(upReq.ctx, uploads)
+			return uploadResponse(c, Upload{}, err)
+		}
+
+		upReq.src = file
+		upReq.filename = file.FileName()
+		upload, err := processUpload(upReq)
+		file.Close()
+		if err != nil {
+			deleteUploads(upReq.ctx, uploads)
+			return uploadResponse(c, upload, err)
+		}
+		uploads = append(uploads, upload)
+	}
+
+	// the collection is created before the files are changed, so they are
+	// never visible without it
+	changed := applyTrailingFields(uploads, fields, trailing, cli)
+	var collection Upload
+	if len(uploads) > 1 {
+		// the collection is created with its final access key
+		if upReq.hold {
+			upReq.accessKey = trailing.Get(accessKeyParamName)
+			upReq.hold = false
+		}
+		title := fields.Get("collection")
+		if title == "" {
+			title = trailing.Get("collection")
+		}
+		collection, err = createCollection(upReq, title, uploads)
+	}
+	if err == nil && changed {
+		err = storeMetadata(upReq.ctx, uploads)
+		if err != nil && len(uploads) > 1 {
+			storageBackend.Delete(context.WithoutCancel(upReq.ctx), collection.Filename)
+		}
+	}
+	if err != nil {
+		deleteUploads(upReq.ctx, uploads)
+	}
+	releaseUploads(uploads)
+
+	if len(uploads) == 1 {
+		return uploadResponse(c, uploads[0], err)
+	}
+	return collectionResponse(c, collection, uploads, err)
+}
+
+// uploadResponse answers an upload through the web form, with json if the
+// client asked for it
+func uploadResponse(c echo.Context, upload Upload, err error) error {
+	r := c.Request()
 
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if errors.Is(err, FileTooLargeError) || errors.Is(err, backends.FileEmptyError) || errors.Is(err, TooManyFilesError) {
 			return badRequestHandler(c, RespJSON, err.Error())
 		} else if err != nil {
 			return oopsHandler(c, RespJSON, "Could not upload file: "+err.Error())
@@ -102,7 +225,7 @@ func uploadPostHandler(c echo.Context) error {
 
 		return c.JSON(http.StatusOK, generateJSONresponse(upload, r))
 	} else {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if errors.Is(err, FileTooLargeError) || errors.Is(err, backends.FileEmptyError) || errors.Is(err, TooManyFilesError) {
 			return badRequestHandler(c, RespHTML, err.Error())
 		} else if err != nil {
 			return oopsHandler(c, RespHTML, "Could not upload file: "+err.Error())
@@ -126,7 +249,7 @@ func uploadPutHandler(c echo.Context) error {
 	upload, err := processUpload(upReq)
 
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if errors.Is(err, FileTooLargeError) || errors.Is(err, backends.FileEmptyError) {
 			return badRequestHandler(c, RespJSON, err.Error())
 		} else if err != nil {
 			return oopsHandler(c, RespJSON, "Could not upload file: "+err.Error())
@@ -134,7 +257,7 @@ func uploadPutHandler(c echo.Context) error {
 
 		return c.JSON(http.StatusOK, generateJSONresponse(upload, r))
 	} else {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if errors.Is(err, FileTooLargeError) || errors.Is(err, backends.FileEmptyError) {
 			return badRequestHandler(c, RespPLAIN, err.Error())
 		} else if err != nil {
 			return oopsHandler(c, RespPLAIN, "Could not upload file: "+err.Error())
@@ -144,6 +267,72 @@ func uploadPutHandler(c echo.Context) error {
 	}
 }
 
+// nextFilePart collects the form fields up to the first file part and returns
+// that part
+func nextFilePart(parts *multipart.Reader, fields url.Values) (*multipart.Part, error) {
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			return part, nil
+		}
+
+		err = readField(part, fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readField(part *multipart.Part, fields url.Values) error {
+	defer part.Close()
+	if part.FileName() != "" {
+		return nil
+	}
+
+	value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+	if err != nil {
+		return err
+	}
+	fields.Add(part.FormName(), string(value))
+	return nil
+}
+
+// applyTrailingFields sets the expiry and access key of the uploads if
+// fields that were sent after the files ask for them. It reports whether
+// the metadata has to be stored again.
+func applyTrailingFields(uploads []Upload, fields, trailing url.Values, cli bool) bool {
+	setExpiry := !fields.Has("expires") && trailing.Has("expires")
+	setAccessKey := !fields.Has(accessKeyParamName) && trailing.Get(accessKeyParamName) != ""
+	for i := range uploads {
+		if setExpiry {
+			uploads[i].Metadata.Expiry = expiryTime(parseExpiry(trailing.Get("expires"), cli))
+		}
+		if setAccessKey {
+			uploads[i].Metadata.AccessKey = trailing.Get(accessKeyParamName)
+		}
+	}
+	return setExpiry || setAccessKey
+}
+
+func storeMetadata(ctx context.Context, uploads []Upload) error {
+	for _, upload := range uploads {
+		err := storageBackend.PutMetadata(ctx, upload.Filename, upload.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteUploads(ctx context.Context, uploads []Upload) {
+	for _, upload := range uploads {
+		storageBackend.Delete(context.WithoutCancel(ctx), upload.Filename)
+	}
+}
+
 func uploadHeaderProcess(r *http.Request, upReq *UploadRequest) {
 	upReq.deleteKey = r.Header.Get("Linx-Delete-Key")
 	upReq.accessKey = r.Header.Get(accessKeyHeaderName)
@@ -162,6 +351,8 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 		return upload, errors.New("filename too large")
 	}
 	upReq.filename = bluemonday.StrictPolicy().Sanitize(upReq.filename)
+	// the size isn't known up front for streamed uploads
+	src := &limitReader{r: upReq.src, n: Config.maxSize}
 
 	// Determine the appropriate filename
 	barename, extension := barePlusExt(upReq.filename)
@@ -170,7 +361,7 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 	if len(extension) == 0 {
 		// Pull the first 512 bytes off for use in MIME detection
 		header = make([]byte, helpers.MimetypeDetectLimit)
-		n, _ := upReq.src.Read(header)
+		n, _ := src.Read(header)
 		if n == 0 {
 			return upload, backends.FileEmptyError
 		}
@@ -185,35 +376,38 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 		}
 	}
 
-	for _, e := range Config.forbiddenExtensions {
-		if extension == e {
-			return upload, errors.New("forbidden file extension")
-		}
+	if forbiddenExtension(extension) {
+		return upload, errors.New("forbidden file extension")
 	}
 
 	for {
 		slug := generateBarename()
 		upload.Filename = strings.Join([]string{slug, extension}, ".")
-		exists, err := storageBackend.Exists(upReq.ctx, upload.Filename)
-		if err != nil {
-			return upload, err
-		}
-		if !exists {
+		err = backends.Reserve(upReq.ctx, storageBackend, upload.Filename)
+		if err == nil {
 			break
+		} else if err != backends.FileExistsErr {
+			return upload, err
 		}
 	}
+	if upReq.hold {
+		holdUpload(upload.Filename)
+	}
+
+	// give the name back if the upload doesn't make it into storage
+	defer func() {
+		if err != nil {
+			storageBackend.Delete(context.WithoutCancel(upReq.ctx), upload.Filename)
+			releaseUploads([]Upload{upload})
+		}
+	}()
 
 	if fileBlacklist[strings.ToLower(upload.Filename)] {
 		return upload, errors.New("Prohibited filename")
 	}
 
 	// Get the rest of the metadata needed for storage
-	var fileExpiry time.Time
-	if upReq.expiry == 0 {
-		fileExpiry = expiry.NeverExpire
-	} else {
-		fileExpiry = time.Now().Add(upReq.expiry)
-	}
+	fileExpiry := expiryTime(upReq.expiry)
 
 	if upReq.deleteKey == "" {
 		upReq.deleteKey = uniuri.NewLen(30)
@@ -223,14 +417,58 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 		upReq.filename = upload.Filename
 	}
 
-	upload.Metadata, err = storageBackend.Put(upReq.ctx, upload.Filename, upReq.filename, io.MultiReader(bytes.NewReader(header), upReq.src), fileExpiry, upReq.deleteKey, upReq.accessKey)
-	if err != nil {
+	upload.Metadata, err = storageBackend.Put(upReq.ctx, upload.Filename, upReq.filename, io.MultiReader(bytes.NewReader(header), src), fileExpiry, upReq.deleteKey, upReq.accessKey)
+	if src.exceeded || errors.Is(err, memory.FileTooLargeError) {
+		// backends may wrap or replace the error of the reader, or have a
+		// lower limit of their own
+		return upload, FileTooLargeError
+	} else if err != nil {
 		return upload, err
 	}
 
 	return
 }
 
+func forbiddenExtension(extension string) bool {
+	for _, e := range Config.forbiddenExtensions {
+		if extension == e {
+			return true
+		}
+	}
+	return false
+}
+
+func expiryTime(d time.Duration) time.Time {
+	if d == 0 {
+		return expiry.NeverExpire
+	}
+	return time.Now().Add(d)
+}
+
+// limitReader fails with FileTooLargeError once more than n bytes are read
+type limitReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, FileTooLargeError
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		l.exceeded = true
+		return 0, FileTooLargeError
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
 func generateBarename() string {
 	return uniuri.NewLenChars(10, []byte("abcdefghijklmnopqrstuvwxyz0123456789"))
 }
@@ -247,6 +485,7 @@ func generateJSONresponse(upload Upload, r *http.Request) map[string]string {
 		"size":          strconv.FormatInt(upload.Metadata.Size, 10),
 		"mimetype":      upload.Metadata.Mimetype,
 		"sha256sum":     upload.Metadata.Sha256sum,
+		"created_at":    strconv.FormatInt(backends.UnixTimestamp(upload.Metadata.CreatedAt), 10),
 	}
 }
 
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/labstack/echo/v4"
+)
+
+// Zip archives of several files are written straight into the response
+// while the files are read from storage, nothing is buffered on disk.
+
+// compressedMimetypes are stored in archives as they are, deflating them
+// again would cost time without making them smaller
+var compressedMimetypes = map[string]bool{
+	"application/epub+zip":         true,
+	"application/gzip":             true,
+	"application/java-archive":     true,
+	"application/vnd.rar":          true,
+	"application/x-7z-compressed":  true,
+	"application/x-bzip2":          true,
+	"application/x-gzip":           true,
+	"application/x-rar-compressed": true,
+	"application/x-xz":             true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"image/avif":                   true,
+	"image/gif":                    true,
+	"image/heic":                   true,
+	"image/jpeg":                   true,
+	"image/png":                    true,
+	"image/webp":                   true,
+}
+
+func zipMethod(mime string) uint16 {
+	mime, _, _ = strings.Cut(mime, ";")
+	if compressedMimetypes[mime] || strings.HasPrefix(mime, "video/") ||
+		(strings.HasPrefix(mime, "audio/") && mime != "audio/wav" && mime != "audio/x-wav") ||
+		strings.HasPrefix(mime, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(mime, "application/vnd.oasis.opendocument.") {
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+type zipEntry struct {
+	Filename string
+	Metadata backends.Metadata
+}
+
+// zipCollectionHandler serves the files of a collection that are accessible
+// with the access key of the collection
+func zipCollectionHandler(c echo.Context) error {
+	r := c.Request()
+	ctx := r.Context()
+	fileName := c.Param("name")
+
+	metadata, err := checkFile(ctx, fileName)
+	if err == backends.NotFoundErr || (err == nil && !isCollection(metadata)) {
+		return notFoundHandler(c)
+	} else if err != nil {
+		return oopsHandler(c, RespAUTO, "Corrupt metadata.")
+	}
+
+	if src, err := checkAccessKey(r, &metadata); err != nil {
+		// remove invalid cookie
+		if src == accessKeySourceCookie {
+			setAccessKeyCookies(c.Response().Writer, getSiteURL(r), fileName, "", time.Unix(0, 0))
+		}
+		return echo.ErrUnauthorized
+	}
+
+	if hotlinked(r) {
+		return c.Redirect(303, Config.sitePath+fileName)
+	}
+
+	manifest, err := loadCollection(ctx, fileName)
+	if err != nil {
+		return oopsHandler(c, RespAUTO, "Corrupt collection.")
+	}
+
+	var entries []zipEntry
+	for _, name := range manifest.Files {
+		fileMetadata, err := checkFile(ctx, name)
+		if err != nil {
+			continue
+		}
+		// files with a key of their own have to be downloaded one by one
+		if fileMetadata.AccessKey != "" && fileMetadata.AccessKey != metadata.AccessKey {
+			continue
+		}
+		entries = append(entries, zipEntry{Filename: name, Metadata: fileMetadata})
+	}
+
+	zipName := metadata.OriginalName
+	if zipName == "" {
+		zipName = strings.TrimSuffix(fileName, path.Ext(fileName))
+	}
+	return zipResponse(c, zipName+".zip", entries)
+}
+
+// zipFilesHandler serves the files listed in the files parameter, every
+// access key they have must be given
+func zipFilesHandler(c echo.Context) error {
+	r := c.Request()
+	ctx := r.Context()
+
+	var names []string
+	for _, value := range r.URL.Query()["files"] {
+		for _, name := range strings.Split(value, ",") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return badRequestHandler(c, RespAUTO, "No files")
+	} else if len(names) > maxCollectionFiles {
+		return badRequestHandler(c, RespAUTO, TooManyFilesError.Error())
+	}
+
+	var entries []zipEntry
+	for _, name := range names {
+		metadata, err := checkFile(ctx, name)
+		if err == backends.NotFoundErr || (err == nil && isCollection(metadata)) {
+			return badRequestHandler(c, RespAUTO, "File not found: "+name)
+		} else if err != nil {
+			return oopsHandler(c, RespAUTO, "Corrupt metadata.")
+		}
+
+		if _, err := checkAccessKey(r, &metadata); err != nil {
+			return echo.ErrUnauthorized
+		}
+		entries = append(entries, zipEntry{Filename: name, Metadata: metadata})
+	}
+
+	// there is no page of the files together, a single file has its own
+	if hotlinked(r) {
+		if len(names) == 1 {
+			return c.Redirect(303, Config.sitePath+names[0])
+		}
+		return c.Redirect(303, Config.sitePath)
+	}
+
+	return zipResponse(c, "files.zip", entries)
+}
+
+func zipResponse(c echo.Context, zipName string, entries []zipEntry) error {
+	ctx := c.Request().Context()
+
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", strings.Replace(zipName, `"`, ``, -1)))
+	c.Response().Header().Set("Content-Type", "application/zip")
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().WriteHeader(200)
+
+	zw := zip.NewWriter(c.Response())
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		header := &zip.FileHeader{
+			Name:     zipEntryName(entry, names),
+			Method:   zipMethod(entry.Metadata.Mimetype),
+			Modified: entry.Metadata.CreatedAt,
+		}
+		header.SetMode(0644)
+
+		err := zipFile(ctx, zw, header, entry.Filename)
+		if err != nil {
+			// the status is sent already, the archive is left without its
+			// central directory so it can't be mistaken for a complete one
+			log.Printf("Could not zip %s: %v", entry.Filename, err)
+			return nil
+		}
+		markAccessed(ctx, entry.Filename, entry.Metadata)
+	}
+
+	return zw.Close()
+}
+
+func zipFile(ctx context.Context, zw *zip.Writer, header *zip.FileHeader, fileName string) error {
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, reader, err := storageBackend.Get(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// zipEntryName is the original name of a file, numbered if an earlier file
+// in the archive has the same name
+func zipEntryName(entry zipEntry, names map[string]bool) string {
+	name := path.Base(strings.ReplaceAll(entry.Metadata.OriginalName, "\\", "/"))
+	if name == "." || name == "/" || name == "" {
+		name = entry.Filename
+	}
+
+	ext := path.Ext(name)
+	bare := strings.TrimSuffix(name, ext)
+	for i := 2; names[name]; i++ {
+		name = bare + " (" + strconv.Itoa(i) + ")" + ext
+	}
+	names[name] = true
+	return name
+}